@@ -1,3 +1,4 @@
-// Package quit contains a global shutdown channel that can be used to broadcast a shutdown event to all goroutines that
-// are currently running.
+// Package quit coordinates the graceful shutdown of the goroutines of a process with a Lifecycle, which broadcasts a
+// shutdown event to all the goroutines that are currently running, waits for them to stop, and then runs the shutdown
+// hooks. The package level functions operate on the process wide default Lifecycle.
 package quit
@@ -1,28 +1,124 @@
 package quit
 
-import "sync"
+import (
+	"context"
+	"sync"
 
-var (
-	waiter sync.WaitGroup
-	quitCh chan struct{}
+	"go.uber.org/multierr"
 )
 
-func init() {
-	quitCh = make(chan struct{})
+// Lifecycle coordinates the graceful shutdown of the goroutines of a process. Goroutines that need to be waited on
+// register with the Waiter, and watch the Done channel (or the Context) to know when to stop. Shutdown broadcasts the
+// shutdown to all of them, and can safely be called any number of times from any goroutine.
+//
+// Multiple apps (e.g., a webstd.App and a workerstd.App) can share a single Lifecycle, so that a shutdown of one stops
+// all of them.
+type Lifecycle struct {
+	waiter sync.WaitGroup
+
+	quitCh       chan struct{}
+	shutdownOnce sync.Once
+	ctx          context.Context
+	cancel       context.CancelFunc
+
+	hooksMu  sync.Mutex
+	hooks    []func(ctx context.Context) error
+	hooksRun bool
+	hooksErr error
+}
+
+// New returns a new Lifecycle that has not been shut down.
+func New() *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Lifecycle{
+		quitCh: make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Shutdown broadcasts a message to all goroutines that are subscribing to the quit channel, and cancels the context of
+// the Lifecycle. This works because a channel close works like a message broadcast on all listeners subscribed to the
+// channel. Only the first call has an effect, so this is safe to call multiple times.
+func (l *Lifecycle) Shutdown() {
+	l.shutdownOnce.Do(func() {
+		close(l.quitCh)
+		l.cancel()
+	})
+}
+
+// Done returns a channel that is closed when the Lifecycle is shut down.
+func (l *Lifecycle) Done() <-chan struct{} {
+	return l.quitCh
+}
+
+// Context returns a context that is cancelled when the Lifecycle is shut down.
+func (l *Lifecycle) Context() context.Context {
+	return l.ctx
+}
+
+// Waiter returns the wait group of the goroutines that should be waited on before the process exits.
+func (l *Lifecycle) Waiter() *sync.WaitGroup {
+	return &l.waiter
+}
+
+// OnShutdown registers a hook that is run by Wait after all the goroutines of the Waiter have stopped. The hooks are run
+// in the reverse order in which they were registered (like defer), so that resources are released in the opposite
+// order that they were acquired.
+func (l *Lifecycle) OnShutdown(hook func(ctx context.Context) error) {
+	l.hooksMu.Lock()
+	defer l.hooksMu.Unlock()
+	l.hooks = append(l.hooks, hook)
+}
+
+// Wait waits for all the goroutines of the Waiter to stop, and then runs the shutdown hooks. The hooks are only run
+// once, with later calls returning the same result. This returns the context error without running the hooks if the
+// context is done before the goroutines stop, and otherwise the combined errors of the hooks.
+func (l *Lifecycle) Wait(ctx context.Context) error {
+	doneCh := make(chan struct{})
+	go func() {
+		l.waiter.Wait()
+		close(doneCh)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-doneCh:
+	}
+
+	l.hooksMu.Lock()
+	defer l.hooksMu.Unlock()
+	if l.hooksRun {
+		return l.hooksErr
+	}
+	l.hooksRun = true
+	for i := len(l.hooks) - 1; i >= 0; i-- {
+		l.hooksErr = multierr.Append(l.hooksErr, l.hooks[i](ctx))
+	}
+	return l.hooksErr
+}
+
+// defaultLifecycle is the Lifecycle that backs the package level functions, and is used by the apps that are not
+// configured with their own Lifecycle.
+var defaultLifecycle = New()
+
+// Default returns the process wide default Lifecycle, which is the one used by GetQuitChannel, GetWaiter and
+// BroadcastShutdown.
+func Default() *Lifecycle {
+	return defaultLifecycle
 }
 
+// GetQuitChannel returns the quit channel of the default Lifecycle.
 func GetQuitChannel() chan struct{} {
-	return quitCh
+	return defaultLifecycle.quitCh
 }
 
+// GetWaiter returns the wait group of the default Lifecycle.
 func GetWaiter() *sync.WaitGroup {
-	return &waiter
+	return defaultLifecycle.Waiter()
 }
 
-// BroadcastShutdown broadcasts a message to all goroutines that are subscribing to the quit channel. This works because
-// a channel close works like a message broadcast on all listeners subscribed to the channel. Ideally we can send a
-// message normally, but in go message sends to channels always work in a fan-out fashion. That is, only one listener
-// can get the message instead of all.
+// BroadcastShutdown shuts down the default Lifecycle. See Lifecycle.Shutdown.
 func BroadcastShutdown() {
-	close(quitCh)
+	defaultLifecycle.Shutdown()
 }
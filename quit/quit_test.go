@@ -0,0 +1,51 @@
+package quit
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLifecycleShutdown(t *testing.T) {
+	lc := New()
+
+	var hookOrder []int
+	for i := 1; i <= 3; i++ {
+		i := i
+		lc.OnShutdown(func(ctx context.Context) error {
+			hookOrder = append(hookOrder, i)
+			return nil
+		})
+	}
+
+	waiter := lc.Waiter()
+	waiter.Add(1)
+	go func() {
+		defer waiter.Done()
+		<-lc.Done()
+	}()
+
+	// Shutdown is safe to call more than once.
+	lc.Shutdown()
+	lc.Shutdown()
+	select {
+	case <-lc.Done():
+	default:
+		t.Error("Done channel is not closed after Shutdown")
+	}
+	if err := lc.Context().Err(); err != context.Canceled {
+		t.Errorf("Context error = %v, want %v", err, context.Canceled)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		if err := lc.Wait(ctx); err != nil {
+			t.Fatalf("Wait returned error: %s", err)
+		}
+	}
+	if want := []int{3, 2, 1}; !reflect.DeepEqual(hookOrder, want) {
+		t.Errorf("Hooks ran in order %v, want %v once", hookOrder, want)
+	}
+}
@@ -0,0 +1,3 @@
+// Package supervisor contains a runner for processes that are composed of multiple long running components, such as a
+// webstd.App serving HTTP along with a workerstd.App consuming tasks.
+package supervisor
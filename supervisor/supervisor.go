@@ -0,0 +1,134 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// Component is a long running part of the process. Run must block until the component stops, and must gracefully shut
+// down the component when the given context is cancelled. Both webstd.App and workerstd.App implement this interface.
+type Component interface {
+	Run(ctx context.Context) error
+}
+
+// ComponentFunc is an adapter to allow the use of ordinary functions as a Component.
+type ComponentFunc func(ctx context.Context) error
+
+// Run calls f(ctx).
+func (f ComponentFunc) Run(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Supervisor runs a set of components together, in the spirit of errgroup. When any of the components stops, or the
+// context passed to Run is cancelled, all the other components are cancelled and the supervisor waits up to
+// ShutdownTimeout duration for them to stop.
+type Supervisor struct {
+	Logger *zap.SugaredLogger
+
+	// ShutdownTimeout is the maximum duration to wait for all the components to stop once the shutdown starts. This
+	// applies on top of the ShutdownTimeout of the individual components. When 0, the supervisor waits until all the
+	// components stop.
+	ShutdownTimeout time.Duration
+
+	components []namedComponent
+}
+
+type namedComponent struct {
+	name      string
+	component Component
+}
+
+type componentResult struct {
+	name string
+	err  error
+}
+
+// Add registers a component to be run by the supervisor. The name is used in logs and errors to identify the
+// component. This must be called before Run.
+func (s *Supervisor) Add(name string, component Component) {
+	s.components = append(s.components, namedComponent{name: name, component: component})
+}
+
+// RunWithSignalHandler runs all the components in the background, and implements a signal handler in the foreground
+// that traps the INT and TERM signals. When the INT or TERM signal is sent to the process, this will start a graceful
+// shutdown of all the components.
+func (s *Supervisor) RunWithSignalHandler() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return s.Run(ctx)
+}
+
+// Run runs all the components in the background until the given context is cancelled or any of the components stops,
+// and then cancels all the components and waits for them to stop. The returned error combines the errors of all the
+// components (prefixed with the component name), along with a timeout error listing the components that did not stop
+// within ShutdownTimeout.
+func (s *Supervisor) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resultCh := make(chan componentResult, len(s.components))
+	running := map[string]bool{}
+	for _, c := range s.components {
+		c := c
+		running[c.name] = true
+		s.Logger.Debugf("Starting component %s", c.name)
+		go func() {
+			resultCh <- componentResult{name: c.name, err: c.component.Run(ctx)}
+		}()
+	}
+
+	var errs error
+	handleResult := func(result componentResult) {
+		delete(running, result.name)
+		if result.err != nil {
+			s.Logger.Errorf("Component %s stopped with error: %s", result.name, result.err)
+			errs = multierr.Append(errs, fmt.Errorf("%s: %w", result.name, result.err))
+			return
+		}
+		s.Logger.Debugf("Component %s stopped", result.name)
+	}
+
+	if len(running) > 0 {
+		select {
+		case <-ctx.Done():
+			s.Logger.Infof("Received shutdown signal. Gracefully shutting down all components...")
+		case result := <-resultCh:
+			handleResult(result)
+			s.Logger.Infof("Component %s stopped. Gracefully shutting down all components...", result.name)
+		}
+	}
+	cancel()
+
+	var timeoutCh <-chan time.Time
+	if s.ShutdownTimeout > 0 {
+		timer := time.NewTimer(s.ShutdownTimeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	for len(running) > 0 {
+		select {
+		case result := <-resultCh:
+			handleResult(result)
+		case <-timeoutCh:
+			pending := make([]string, 0, len(running))
+			for name := range running {
+				pending = append(pending, name)
+			}
+			sort.Strings(pending)
+			s.Logger.Errorf("Timed out waiting for components to shutdown: %s", strings.Join(pending, ", "))
+			return multierr.Append(errs, fmt.Errorf("timeout waiting for components: %s", strings.Join(pending, ", ")))
+		}
+	}
+
+	s.Logger.Infof("All components gracefully shutdown.")
+	return errs
+}
@@ -10,6 +10,7 @@ import (
 	"syscall"
 	"time"
 
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 
 	"github.com/illumitacit/gostd/quit"
@@ -21,6 +22,11 @@ type App struct {
 	Port            int
 	ShutdownTimeout time.Duration
 
+	// Lifecycle controls the shutdown of the server. The server is shut down when the Lifecycle is shut down, and shuts
+	// down the Lifecycle when it stops on its own, so that apps sharing the Lifecycle stop together. The shutdown hooks
+	// of the Lifecycle are run after the server has stopped. Defaults to quit.Default().
+	Lifecycle *quit.Lifecycle
+
 	// Any addiitonal close routine should be handled in the custom close function passed in here.
 	CloseFn func() error
 }
@@ -29,7 +35,17 @@ type App struct {
 // handler in the foreground that traps the INT and TERM signals. When the INT or TERM signal is sent to the process,
 // this will start a graceful shutdown of the http server, waiting up to ShutdownTimeout duration for all http server
 // threads to stop processing.
-func RunWithSignalHandler(app *App) (returnErr error) {
+func RunWithSignalHandler(app *App) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return app.Run(ctx)
+}
+
+// Run runs the http web app described by the App struct in the background until the given context is cancelled or the
+// Lifecycle is shut down. This will then start a graceful shutdown of the http server, waiting up to ShutdownTimeout
+// duration for all http server threads to stop processing. Unlike RunWithSignalHandler, this does not trap any
+// signals, so that it can be run along with other components (see the supervisor package).
+func (app *App) Run(ctx context.Context) error {
 	listen := fmt.Sprintf(":%d", app.Port)
 	srv := &http.Server{
 		Addr:    listen,
@@ -37,54 +53,70 @@ func RunWithSignalHandler(app *App) (returnErr error) {
 	}
 
 	// Start the server in the background so that we can handle shutdown signals gracefully.
-	waiter := quit.GetWaiter()
+	lc := app.lifecycle()
+	errCh := make(chan error, 1)
+	waiter := lc.Waiter()
 	waiter.Add(1)
 	go func() {
 		defer waiter.Done()
+		// If the server stops on its own (e.g., the port is in use), shut down the rest of the process as well.
+		defer lc.Shutdown()
 
+		var err error
 		app.Logger.Debug("Starting Web server")
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			app.Logger.Debugf("Error shutting down: %s", err)
-			if returnErr == nil {
-				returnErr = err
-			}
+		if serveErr := srv.ListenAndServe(); serveErr != http.ErrServerClosed {
+			app.Logger.Debugf("Error shutting down: %s", serveErr)
+			err = serveErr
 		}
 
 		if app.CloseFn != nil {
 			app.Logger.Debug("Handling additional shutdown tasks")
-			if err := app.CloseFn(); err != nil {
-				app.Logger.Debugf("Error running additional shutdown tasks: %s", err)
-				if returnErr == nil {
-					returnErr = err
-				}
+			if closeErr := app.CloseFn(); closeErr != nil {
+				app.Logger.Debugf("Error running additional shutdown tasks: %s", closeErr)
+				err = multierr.Append(err, closeErr)
 			}
 		}
+		errCh <- err
 	}()
-	go func() {
-		waiter.Wait()
-		app.Logger.Debug("Shutting down server")
-		quit.BroadcastShutdown()
-	}()
-
-	// Wait for interrupt signal to gracefully shutdown the server with a configurable timeout.
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
-	<-sigCh
 
-	// At this point, an interrupt signal was triggered (SIGINT or SIGTERM), so start to gracefully shutdown the server.
-	app.Logger.Infof("Received interrupt signal. Gracefully shutting down server...")
+	// Wait for the context to be cancelled, or for the Lifecycle to be shut down by another app, to gracefully shutdown
+	// the server with a configurable timeout.
+	select {
+	case <-ctx.Done():
+		app.Logger.Infof("Received shutdown signal. Gracefully shutting down server...")
+	case <-lc.Done():
+		app.Logger.Infof("Received shutdown message. Gracefully shutting down server...")
+	}
 	timeout, cancel := context.WithTimeout(context.Background(), app.ShutdownTimeout)
 	defer cancel()
+	lc.Shutdown()
 	if err := srv.Shutdown(timeout); err != nil && !errors.Is(err, context.DeadlineExceeded) {
 		app.Logger.Errorf("Error shutting down server: %s", err)
+		// The server goroutine still exits as the listener is closed, so run the shutdown hooks as usual.
+		if waitErr := lc.Wait(timeout); waitErr != nil {
+			app.Logger.Errorf("Error running shutdown hooks: %s", waitErr)
+			return multierr.Append(err, waitErr)
+		}
 		return err
 	}
 	select {
 	case <-timeout.Done():
 		app.Logger.Errorf("Timed out waiting for server to shutdown.")
 		return fmt.Errorf("timeout")
-	case <-quit.GetQuitChannel():
+	case serveErr := <-errCh:
+		if err := lc.Wait(timeout); err != nil {
+			app.Logger.Errorf("Error running shutdown hooks: %s", err)
+			return multierr.Append(serveErr, err)
+		}
 		app.Logger.Infof("All services gracefully shutdown.")
+		return serveErr
+	}
+}
+
+// lifecycle returns the Lifecycle that controls the shutdown of the server.
+func (app *App) lifecycle() *quit.Lifecycle {
+	if app.Lifecycle != nil {
+		return app.Lifecycle
 	}
-	return nil
+	return quit.Default()
 }
@@ -0,0 +1,224 @@
+package workerstd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"gocloud.dev/pubsub"
+)
+
+// msgSettler acknowledges messages based on the result of the task handler. This is only used when AutoAck is enabled
+// on the App.
+type msgSettler struct {
+	app          *App
+	broker       *Broker
+	subscription *SubClient
+	retryPolicy  *RetryPolicy
+
+	// retryClt is the publisher client used to republish tasks that are being retried or requeued. Only set when a
+	// RetryPolicy or RateLimits are configured.
+	retryClt *PubClient
+
+	// delayedNack is the registered engine of the broker, when it can redeliver nacked messages after the backoff of the
+	// RetryPolicy.
+	delayedNack DelayedNackEngine
+}
+
+// newMsgSettler returns a msgSettler for a subscription of the given worker app, opening the publisher client for
+// retrying tasks on the broker as necessary. This returns an error if the broker can not redeliver the retried tasks to
+// the subscription alone.
+func newMsgSettler(app *App, broker *Broker, subscription *SubClient, ctx context.Context) (*msgSettler, error) {
+	s := &msgSettler{
+		app:          app,
+		broker:       broker,
+		subscription: subscription,
+		retryPolicy:  broker.RetryPolicy,
+	}
+
+	retries := s.retryPolicy != nil && s.retryPolicy.maxAttempts() > 1
+	if !builtinEngines[broker.Engine] && retries {
+		engine, err := lookupEngine(broker.Engine)
+		if err != nil {
+			return nil, err
+		}
+		delayedNack, ok := engine.(DelayedNackEngine)
+		if !ok {
+			return nil, fmt.Errorf(
+				"RetryPolicy with more than 1 attempt is not supported with the %s engine, as it can not redeliver tasks",
+				broker.Engine,
+			)
+		}
+		s.delayedNack = delayedNack
+	}
+
+	if (retries && s.delayedNack == nil) || len(app.RateLimits) > 0 {
+		retryClt, err := NewPubClient(app.Logger, broker, ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.retryClt = retryClt
+	}
+
+	return s, nil
+}
+
+// Close closes the publisher client that was opened for the settler.
+func (s *msgSettler) Close() error {
+	return s.retryClt.Close()
+}
+
+// settle acknowledges the message based on the result of the task handler.
+//   - A nil error acks the message.
+//   - An error that wraps ErrPermanent dead-letters the message.
+//   - Any other error (including ErrRetryable) is retried according to the RetryPolicy, and dead-lettered once all the
+//     attempts are exhausted. When there is no RetryPolicy, the message is nacked so that the broker redelivers it.
+func (s *msgSettler) settle(msg *pubsub.Message, taskErr error) {
+	switch {
+	case taskErr == nil:
+		msg.Ack()
+	case errors.Is(taskErr, ErrPermanent):
+		s.deadLetter(msg, taskErr)
+	case s.retryPolicy == nil:
+		nackMsg(s.app.Logger, msg)
+	default:
+		s.retry(msg, taskErr)
+	}
+}
+
+// handBack returns the message of a task that was interrupted by the shutdown of the worker to the broker, so that it
+// is processed again by the same attempt. The task is requeued when possible, as nacking the message counts as an
+// attempt on the engines that count the attempts from the delivery count of the broker.
+func (s *msgSettler) handBack(msg *pubsub.Message) {
+	if s.canResend() {
+		s.requeue(msg, time.Now())
+		return
+	}
+	nackMsg(s.app.Logger, msg)
+}
+
+// retry redelivers the task to the subscription for another attempt, or dead-letters the task if all the attempts are
+// exhausted. See RetryPolicy for how the task is redelivered on each engine.
+func (s *msgSettler) retry(msg *pubsub.Message, taskErr error) {
+	attempt := msgAttempt(msg)
+	if attempt >= s.retryPolicy.maxAttempts() {
+		s.app.Logger.Errorf("Task %s exhausted all %d attempts. Dead-lettering.", msg.LoggableID, attempt)
+		s.deadLetter(msg, taskErr)
+		return
+	}
+
+	backoff := s.retryPolicy.backoff(attempt)
+	if s.canResend() {
+		s.app.Logger.Infof("Retrying task %s (attempt %d) in %s", msg.LoggableID, attempt+1, backoff)
+		resend := copyMsgForResend(msg, attempt+1)
+		if err := s.resend(context.Background(), resend, time.Now().Add(backoff)); err != nil {
+			s.app.Logger.Errorf("Error republishing task %s for retry: %s", msg.LoggableID, err)
+			nackMsg(s.app.Logger, msg)
+			return
+		}
+		msg.Ack()
+		return
+	}
+	if s.delayedNack != nil {
+		s.app.Logger.Infof(
+			"Retrying task %s (attempt %d) in %s by redelivery from the broker", msg.LoggableID, attempt+1, backoff,
+		)
+		if err := s.delayedNack.NackWithDelay(msg, backoff); err != nil {
+			s.app.Logger.Errorf("Error nacking task %s for retry: %s", msg.LoggableID, err)
+			nackMsg(s.app.Logger, msg)
+		}
+		return
+	}
+
+	// The task can't be republished to this subscription alone, so let the broker redeliver it instead. The attempts are
+	// counted from the delivery count of the broker.
+	s.app.Logger.Infof("Retrying task %s (attempt %d) by redelivery from the broker", msg.LoggableID, attempt+1)
+	nackMsg(s.app.Logger, msg)
+}
+
+// requeue republishes the task to the subscription of the settler to be delivered again at the given time, without
+// counting it as an attempt. The message is nacked instead if the task can not be republished. This must only be called
+// when canResend returns true.
+func (s *msgSettler) requeue(msg *pubsub.Message, at time.Time) {
+	if err := s.resend(context.Background(), copyMsgForResend(msg, msgAttempt(msg)), at); err != nil {
+		s.app.Logger.Errorf("Error requeueing task %s: %s", msg.LoggableID, err)
+		nackMsg(s.app.Logger, msg)
+		return
+	}
+	msg.Ack()
+}
+
+// canResend returns whether tasks can be republished to the subscription of the settler with a delivery time, without
+// delivering them to the other subscriptions of the topic. This is the case for Azure ServiceBus queues, RabbitMQ
+// (through a retry queue that dead-letters to the queue of the subscription), and the mem engine.
+func (s *msgSettler) canResend() bool {
+	switch {
+	case s.retryClt == nil:
+		return false
+	case s.retryClt.sender != nil:
+		return s.broker.ServiceBusSubscriptionName == ""
+	case s.retryClt.rabbit != nil, s.retryClt.shared:
+		return true
+	}
+	return false
+}
+
+// resend republishes the given message to the subscription of the settler, to be delivered at the given time. This
+// must only be called when canResend returns true. Note that unlike the PubClient send functions, this does not start a
+// publish span, so that the message stays in the trace that it was originally sent in.
+func (s *msgSettler) resend(ctx context.Context, msg *pubsub.Message, at time.Time) error {
+	if s.retryClt.rabbit != nil {
+		publishing := rabbitMQPublishing(msg, "")
+		return s.retryClt.rabbit.publishRetry(ctx, rabbitMQQueueName(s.broker), publishing, at)
+	}
+
+	sendOpts := &sendOptions{deliveryTime: at}
+	sendOpts.apply(msg)
+	return s.retryClt.sendScheduledMsg(ctx, msg, sendOpts)
+}
+
+// deadLetter moves the message to the dead-letter destination of the broker.
+func (s *msgSettler) deadLetter(msg *pubsub.Message, taskErr error) {
+	if err := s.subscription.DeadLetter(context.Background(), msg, taskErr); err != nil {
+		s.app.Logger.Errorf("Error dead-lettering message %s: %s", msg.LoggableID, err)
+		nackMsg(s.app.Logger, msg)
+	}
+}
+
+// nackMsg nacks the message if the broker supports it. Otherwise, the message is left as is so that it is redelivered
+// once the lock expires.
+func nackMsg(logger *zap.SugaredLogger, msg *pubsub.Message) {
+	if !msg.Nackable() {
+		logger.Warnf("Message %s can not be nacked. Waiting for broker to redeliver.", msg.LoggableID)
+		return
+	}
+	msg.Nack()
+}
+
+// nackMsgAfterPanic nacks the message after the task handler panicked. Since the handler may have already settled the
+// message before panicking, this guards against the panic that pubsub raises when a message is settled twice.
+func nackMsgAfterPanic(app *App, msg *pubsub.Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			app.Logger.Debugf("Message %s was already settled by the task handler before panicking", msg.LoggableID)
+		}
+	}()
+	nackMsg(app.Logger, msg)
+}
+
+// settleAutoAckedMsg runs the given function to settle the message of a task when AutoAck is enabled. Legacy task
+// handlers may still settle the message themselves, so this guards against the panic that pubsub raises when a message
+// is settled twice, and reports the misuse.
+func settleAutoAckedMsg(app *App, msg *pubsub.Message, settleFn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			app.Logger.Warnf(
+				"Message %s was already settled by the task handler. Task handlers must not settle messages with AutoAck.",
+				msg.LoggableID,
+			)
+		}
+	}()
+	settleFn()
+}
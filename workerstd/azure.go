@@ -0,0 +1,60 @@
+package workerstd
+
+import (
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+)
+
+// Values of the AzureAuthMode field of the Broker, which selects how the clients authenticate with Azure ServiceBus.
+const (
+	// AzureAuthModeDefault authenticates with the DefaultAzureCredential, which tries the environment, workload
+	// identity, managed identity and Azure CLI credentials in turn.
+	AzureAuthModeDefault = "default"
+
+	// AzureAuthModeConnectionString authenticates with the shared access key that is embedded in the ConnectionString
+	// (e.g., Endpoint=sb://NAMESPACE.servicebus.windows.net/;SharedAccessKeyName=KEYNAME;SharedAccessKey=KEY). This is
+	// the mode to use with the ServiceBus emulator.
+	AzureAuthModeConnectionString = "connection_string"
+
+	// AzureAuthModeManagedIdentity authenticates with the managed identity of the host. When AzureClientID is set, the
+	// user-assigned identity with that client ID is used instead of the system-assigned identity.
+	AzureAuthModeManagedIdentity = "managed_identity"
+
+	// AzureAuthModeWorkloadIdentity authenticates with Azure AD workload identity on Kubernetes, using the environment
+	// variables that are set by the workload identity webhook. AzureClientID overrides the AZURE_CLIENT_ID variable.
+	AzureAuthModeWorkloadIdentity = "workload_identity"
+)
+
+// newAzureSBClient returns an Azure ServiceBus client for the namespace configured on the broker, authenticated
+// according to the AzureAuthMode of the broker.
+func newAzureSBClient(broker *Broker) (*azservicebus.Client, error) {
+	if broker.AzureAuthMode == AzureAuthModeConnectionString {
+		return azservicebus.NewClientFromConnectionString(broker.ConnectionString, nil)
+	}
+
+	var cred azcore.TokenCredential
+	var err error
+	switch broker.AzureAuthMode {
+	case "", AzureAuthModeDefault:
+		cred, err = azidentity.NewDefaultAzureCredential(nil)
+	case AzureAuthModeManagedIdentity:
+		opts := &azidentity.ManagedIdentityCredentialOptions{}
+		if broker.AzureClientID != "" {
+			opts.ID = azidentity.ClientID(broker.AzureClientID)
+		}
+		cred, err = azidentity.NewManagedIdentityCredential(opts)
+	case AzureAuthModeWorkloadIdentity:
+		cred, err = azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+			ClientID: broker.AzureClientID,
+		})
+	default:
+		return nil, fmt.Errorf("Unknown Azure auth mode %s", broker.AzureAuthMode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return azservicebus.NewClient(broker.ConnectionString, cred, nil)
+}
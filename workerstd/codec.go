@@ -0,0 +1,118 @@
+package workerstd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Content types of the builtin codecs, which are recorded in the MetadataKeyContentType metadata of the message.
+const (
+	ContentTypeProtobuf  = "application/x-protobuf"
+	ContentTypeProtoJSON = "application/x-protobuf+json"
+	ContentTypeJSON      = "application/json"
+)
+
+// Codec encodes task messages into the body of a pubsub message, and decodes them back. The content type of the codec
+// is recorded in the message metadata by the PubClient so that the SubClient can automatically decode the message with
+// the matching codec.
+type Codec interface {
+	// ContentType returns the MIME type that identifies the encoding of the message body.
+	ContentType() string
+
+	// Marshal encodes the task into the message body.
+	Marshal(task proto.Message) ([]byte, error)
+
+	// Unmarshal decodes the message body into the given task.
+	Unmarshal(body []byte, task proto.Message) error
+}
+
+var (
+	// ProtobufCodec encodes tasks using the protobuf binary wire format. This is the default codec.
+	ProtobufCodec Codec = protobufCodec{}
+
+	// ProtoJSONCodec encodes tasks using the canonical protobuf JSON mapping.
+	ProtoJSONCodec Codec = protoJSONCodec{}
+
+	// JSONCodec encodes tasks using encoding/json. This is useful for exchanging tasks with non-Go systems that don't
+	// use protobuf, but note that it does not follow the protobuf JSON mapping for well known types, enums and oneofs.
+	JSONCodec Codec = jsonCodec{}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		ContentTypeProtobuf:  ProtobufCodec,
+		ContentTypeProtoJSON: ProtoJSONCodec,
+		ContentTypeJSON:      JSONCodec,
+	}
+)
+
+// RegisterCodec registers a custom codec so that the SubClient can decode messages with the content type of the
+// codec. This overrides any codec that is already registered for the same content type.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[codec.ContentType()] = codec
+}
+
+// CodecForContentType returns the registered codec for the given content type. Messages without a content type (e.g.,
+// those that were sent by an older version of the PubClient) are assumed to be encoded with the ProtobufCodec.
+func CodecForContentType(contentType string) (Codec, error) {
+	if contentType == "" {
+		return ProtobufCodec, nil
+	}
+
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, exists := codecs[contentType]
+	if !exists {
+		return nil, fmt.Errorf("Unknown content type %s", contentType)
+	}
+	return codec, nil
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (protobufCodec) Marshal(task proto.Message) ([]byte, error) {
+	return proto.Marshal(task)
+}
+
+func (protobufCodec) Unmarshal(body []byte, task proto.Message) error {
+	return proto.Unmarshal(body, task)
+}
+
+type protoJSONCodec struct{}
+
+func (protoJSONCodec) ContentType() string {
+	return ContentTypeProtoJSON
+}
+
+func (protoJSONCodec) Marshal(task proto.Message) ([]byte, error) {
+	return protojson.Marshal(task)
+}
+
+func (protoJSONCodec) Unmarshal(body []byte, task proto.Message) error {
+	return protojson.Unmarshal(body, task)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) Marshal(task proto.Message) ([]byte, error) {
+	return json.Marshal(task)
+}
+
+func (jsonCodec) Unmarshal(body []byte, task proto.Message) error {
+	return json.Unmarshal(body, task)
+}
@@ -1,22 +1,269 @@
 package workerstd
 
+import (
+	"time"
+
+	"gocloud.dev/pubsub/batcher"
+)
+
 // Broker represents configuration options for the message queue broker used to enqueue tasks for the worker.
 // This can be embedded in a viper compatible config struct.
 type Broker struct {
-	// Engine is the engine of the message broker. Must be one of azuresb or rabbitmq.
+	// Engine is the engine of the message broker. Must be one of azuresb, rabbitmq, or mem, or the name of an engine
+	// that was registered with RegisterEngine (such as nats and kafka, which are registered by importing the natsengine
+	// and kafkaengine packages respectively). The mem engine runs the broker in process, with all the clients in the
+	// process sharing the same topics, and is intended for tests and local development. Note that the mem engine
+	// behaves like a queue, where each task is delivered to only one of the subscribers of a topic. Test suites can
+	// clear the mem topics between tests with ResetMemTopics.
 	Engine string `mapstructure:"engine"`
 
 	// TopicName is the message queue topic where messages are published. This corresponds to the exchange when using
-	// rabbitmq.
+	// rabbitmq, and the subject when using nats.
 	TopicName string `mapstructure:"topic"`
 
 	// ConnectionString is the connection string for connecting to the specific broker. For AzureSB, this is the
-	// ServiceBus Namespace FQDN (NAMESPACE.servicebus.windows.net), while for RabbitMQ this is the server URL in the
-	// format USERNAME:PASSWORD@HOST:PORT.
+	// ServiceBus Namespace FQDN (NAMESPACE.servicebus.windows.net), or the ServiceBus connection string with the shared
+	// access key when AzureAuthMode is connection_string. For RabbitMQ, this is the server URL in the format
+	// USERNAME:PASSWORD@HOST:PORT.
 	ConnectionString string `mapstructure:"connstring"`
 
+	// AzureAuthMode is how the clients authenticate with Azure ServiceBus. Must be one of default (the
+	// DefaultAzureCredential), connection_string, managed_identity, or workload_identity. See the AzureAuthMode
+	// constants for details. Defaults to default. This is only used with Azure ServiceBus.
+	AzureAuthMode string `mapstructure:"azure_auth_mode"`
+
+	// AzureClientID is the client ID of the identity to authenticate as with the managed_identity and workload_identity
+	// AzureAuthMode. When blank, the system-assigned managed identity or the AZURE_CLIENT_ID environment variable is
+	// used respectively. This is only used with Azure ServiceBus.
+	AzureClientID string `mapstructure:"azure_client_id"`
+
 	// ServiceBusSubscriptionName is the Azure ServiceBus Topic Subscription that the worker should consume as. If
 	// blank, assume that the topic is an Azure ServiceBus Queue instead of a Topic. This is only used with Azure
 	// ServiceBus.
 	ServiceBusSubscriptionName string `mapstructure:"subscription"`
+
+	// RetryPolicy is the policy for retrying failed tasks. When nil, failed tasks are nacked and redelivered immediately
+	// by the broker. This is only used when AutoAck is enabled on the worker App.
+	RetryPolicy *RetryPolicy `mapstructure:"retry"`
+
+	// DeadLetterTopicName is the message queue topic where tasks are published when they fail permanently, or when they
+	// have exhausted all the attempts in the RetryPolicy. When blank, the native dead-letter mechanism of the broker is
+	// used instead.
+	DeadLetterTopicName string `mapstructure:"deadletter_topic"`
+
+	// LockRenewalInterval is how often the worker renews the lock on a message while the task waits for the worker and
+	// while the task handler is running, so that long running tasks are not redelivered to another worker while they are
+	// still being processed. When unset, locks are not renewed. This is only supported with Azure ServiceBus, as
+	// RabbitMQ holds unacked messages for the consumer until the channel is closed (subject to the server side
+	// consumer_timeout).
+	LockRenewalInterval time.Duration `mapstructure:"lock_renewal_interval"`
+
+	// MaxProcessingTime is the maximum duration that a task can be processed for, counted from when the task handler is
+	// called. Once this elapses, the context passed to the task handler is cancelled and the worker stops renewing the
+	// lock on the message, so that the broker can redeliver it. When unset, there is no limit.
+	MaxProcessingTime time.Duration `mapstructure:"max_processing_time"`
+
+	// PublishBatching configures how the publisher client batches messages that are sent concurrently (e.g., with
+	// SendTasks or SendTaskAsync). When nil, the default batching of the engine is used. This is only supported with
+	// Azure ServiceBus, Kafka and NATS, as the RabbitMQ driver does not expose batching options.
+	PublishBatching *PublishBatching `mapstructure:"publish_batching"`
+
+	// RabbitMQ configures the connection to RabbitMQ and the topology of the topic when using the rabbitmq engine. When
+	// nil, the clients connect over plain AMQP to the default vhost, and the exchange and queue must already exist.
+	RabbitMQ *RabbitMQConfig `mapstructure:"rabbitmq"`
+
+	// NATS configures the connection to NATS when using the nats engine.
+	NATS *NATSConfig `mapstructure:"nats"`
+
+	// Kafka configures the connection to Kafka when using the kafka engine.
+	Kafka *KafkaConfig `mapstructure:"kafka"`
+}
+
+// RabbitMQConfig represents configuration options for the rabbitmq engine.
+// This can be embedded in a viper compatible config struct.
+type RabbitMQConfig struct {
+	// Scheme is the scheme of the AMQP URL, which must be amqp or amqps (amqps is required when TLS is set). Defaults to
+	// amqps when TLS is set, and amqp otherwise.
+	Scheme string `mapstructure:"scheme"`
+
+	// VHost is the virtual host to connect to. Defaults to the default vhost (/) of the server.
+	VHost string `mapstructure:"vhost"`
+
+	// TLS configures the TLS connection to the server when using the amqps scheme. When nil, the system root CAs are
+	// used to verify the server, and no client certificate is sent.
+	TLS *RabbitMQTLS `mapstructure:"tls"`
+
+	// DeclareTopology determines whether the clients declare the topology of the topic when connecting. When true, the
+	// exchange (fanout), the queue and the binding between them are declared as durable, along with the
+	// DeadLetterExchange and its queue if set. Declaring is idempotent, but fails if the existing exchange or queue was
+	// declared with different settings (e.g., different QueueArgs).
+	DeclareTopology bool `mapstructure:"declare_topology"`
+
+	// QueueName is the queue that the worker consumes, which is bound to the exchange of the topic. Defaults to the
+	// TopicName of the broker.
+	QueueName string `mapstructure:"queue"`
+
+	// QueueArgs are the optional arguments (e.g., x-max-length or x-queue-type) that the queue is declared with. This is
+	// only used when DeclareTopology is true.
+	QueueArgs map[string]interface{} `mapstructure:"queue_args"`
+
+	// DeadLetterExchange is the exchange where RabbitMQ routes the messages that are rejected by the worker, which is
+	// set as the x-dead-letter-exchange argument of the queue. The exchange is declared (fanout) along with a queue of
+	// the same name that retains the dead-lettered messages. This is only used when DeclareTopology is true, and is
+	// superseded by the DeadLetterTopicName of the broker.
+	DeadLetterExchange string `mapstructure:"deadletter_exchange"`
+}
+
+// RabbitMQTLS represents configuration options for the TLS connection to RabbitMQ.
+// This can be embedded in a viper compatible config struct.
+type RabbitMQTLS struct {
+	// CACertFile is the path to the PEM encoded CA certificates that are used to verify the server. When blank, the
+	// system root CAs are used.
+	CACertFile string `mapstructure:"ca_cert_file"`
+
+	// CertFile and KeyFile are the paths to the PEM encoded client certificate and key, for authenticating with the
+	// server using mutual TLS. When set, the client authenticates with the EXTERNAL mechanism, which requires the
+	// rabbitmq_auth_mechanism_ssl plugin on the server, and the credentials in the connection string are not used.
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+
+	// ServerName overrides the host name that is used to verify the server certificate.
+	ServerName string `mapstructure:"server_name"`
+
+	// InsecureSkipVerify disables the verification of the server certificate. This should only be used for testing.
+	InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
+}
+
+// withTopic returns a copy of the broker config for the given topic. The settings that are specific to the topic of
+// the broker (such as the RabbitMQ queue) are reset when the topic is different.
+func (b *Broker) withTopic(topic string) *Broker {
+	topicBroker := *b
+	topicBroker.TopicName = topic
+	if topic != b.TopicName && b.RabbitMQ != nil {
+		rabbitMQ := *b.RabbitMQ
+		rabbitMQ.QueueName = ""
+		rabbitMQ.QueueArgs = nil
+		rabbitMQ.DeadLetterExchange = ""
+		topicBroker.RabbitMQ = &rabbitMQ
+	}
+	if topic != b.TopicName && b.NATS != nil {
+		nats := *b.NATS
+		nats.Stream = ""
+		nats.Consumer = ""
+		topicBroker.NATS = &nats
+	}
+	return &topicBroker
+}
+
+// NATSConfig represents configuration options for the nats engine, which stores the tasks in NATS JetStream. The
+// workers share a durable pull consumer on the stream, so that each task is delivered to only one of the workers, and
+// tasks that are published while no worker is running are retained until they are consumed.
+// This can be embedded in a viper compatible config struct.
+type NATSConfig struct {
+	// URL is the comma separated list of NATS server URLs to connect to (e.g., nats://localhost:4222).
+	URL string `mapstructure:"url"`
+
+	// Stream is the name of the JetStream stream that stores the tasks. Defaults to the stream whose subjects include
+	// the TopicName of the broker.
+	Stream string `mapstructure:"stream"`
+
+	// Consumer is the name of the durable consumer that the workers share. The consumer is created when it does not
+	// exist yet. Defaults to the TopicName of the broker, with the characters that are not allowed in consumer names
+	// replaced with underscores.
+	Consumer string `mapstructure:"consumer"`
+
+	// DeclareStream determines whether the clients create the stream when it does not exist yet. The stream is created
+	// with the work queue retention policy, so that the tasks are removed once they are acknowledged, and the Stream (or
+	// the TopicName when blank) as its name. Note that a work queue stream only allows a single consumer for the
+	// TopicName.
+	DeclareStream bool `mapstructure:"declare_stream"`
+
+	// AckWait is how long JetStream waits for a task to be acknowledged before it is redelivered. This should be longer
+	// than the time it takes to process a task. Defaults to the MaxProcessingTime of the broker when set, and the
+	// JetStream default (30 seconds) otherwise.
+	AckWait time.Duration `mapstructure:"ack_wait"`
+
+	// CredentialsFile is the path to a NATS user credentials file (JWT and NKey seed). When blank, no credentials are
+	// used, unless they are embedded in the URL.
+	CredentialsFile string `mapstructure:"credentials_file"`
+}
+
+// KafkaConfig represents configuration options for the kafka engine.
+// This can be embedded in a viper compatible config struct.
+type KafkaConfig struct {
+	// Brokers is the list of Kafka broker addresses to connect to (e.g., localhost:9092).
+	Brokers []string `mapstructure:"brokers"`
+
+	// ConsumerGroup is the Kafka consumer group that the workers join, so that each task is delivered to only one of
+	// the workers. Defaults to the TopicName of the broker.
+	ConsumerGroup string `mapstructure:"consumer_group"`
+
+	// Version is the Kafka protocol version to use (e.g., 2.8.0). Must be at least 0.11.0, which is the default, as
+	// the task metadata is sent in the message headers.
+	Version string `mapstructure:"version"`
+}
+
+// PublishBatching represents configuration options for batching the messages sent by the publisher client.
+// This can be embedded in a viper compatible config struct.
+type PublishBatching struct {
+	// MaxHandlers is the maximum number of batches that are sent concurrently.
+	MaxHandlers int `mapstructure:"max_handlers"`
+
+	// MinBatchSize is the minimum number of messages in a batch.
+	MinBatchSize int `mapstructure:"min_batch_size"`
+
+	// MaxBatchSize is the maximum number of messages in a batch. Note that Azure ServiceBus only supports sending one
+	// message at a time, so this is capped at 1 for that engine.
+	MaxBatchSize int `mapstructure:"max_batch_size"`
+
+	// MaxBatchByteSize is the maximum size of a batch in bytes.
+	MaxBatchByteSize int `mapstructure:"max_batch_bytesize"`
+}
+
+// BatcherOptions returns the gocloud batcher options corresponding to the batching config.
+func (b *PublishBatching) BatcherOptions() batcher.Options {
+	if b == nil {
+		return batcher.Options{}
+	}
+	return batcher.Options{
+		MaxHandlers:      b.MaxHandlers,
+		MinBatchSize:     b.MinBatchSize,
+		MaxBatchSize:     b.MaxBatchSize,
+		MaxBatchByteSize: b.MaxBatchByteSize,
+	}
+}
+
+// RetryPolicy represents configuration options for retrying failed tasks with exponential backoff.
+// This can be embedded in a viper compatible config struct.
+//
+// Retries only redeliver the task to the subscription of the worker that failed it, and not to the other subscriptions
+// of the topic:
+//   - For Azure ServiceBus queues, RabbitMQ and the mem engine, the task is republished with an incremented attempt
+//     count to be delivered once the backoff has elapsed (see WithDeliveryTime), and the original message is acked. For
+//     RabbitMQ, the task is held in a "<queue>.retry" queue that dead-letters to the queue of the subscription.
+//   - For the registered engines that implement DelayedNackEngine (e.g., NATS JetStream), the message is nacked so
+//     that the broker redelivers it once the backoff has elapsed. The attempts are counted from the delivery count of
+//     the broker.
+//   - For Azure ServiceBus topic subscriptions, the message is nacked so that the broker redelivers it immediately, and
+//     the backoff is not applied. The attempts are counted from the delivery count of the broker.
+//
+// Retries are not supported with the other registered engines (e.g., Kafka), so the worker fails to start when
+// MaxAttempts is greater than 1 with those engines.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a task is attempted, including the first attempt. Once the attempts
+	// are exhausted, the task is dead-lettered. Defaults to 1 (no retries) when unset.
+	MaxAttempts int `mapstructure:"max_attempts"`
+
+	// InitialBackoff is the duration to wait before the first retry. Defaults to 1 second when unset.
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+
+	// MaxBackoff is the maximum duration to wait between retries. When unset, the backoff is not capped.
+	MaxBackoff time.Duration `mapstructure:"max_backoff"`
+
+	// Multiplier is the factor by which the backoff increases after each attempt. Defaults to 2 when less than 1.
+	Multiplier float64 `mapstructure:"multiplier"`
+
+	// Jitter is the fraction of the backoff (between 0 and 1) that is randomly added or subtracted from the backoff, to
+	// avoid retries from many workers lining up.
+	Jitter float64 `mapstructure:"jitter"`
 }
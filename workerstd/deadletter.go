@@ -0,0 +1,240 @@
+package workerstd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+	"gocloud.dev/pubsub"
+)
+
+// DeadLetterPublisher publishes failed tasks to the dead-letter topic configured on the Broker, annotated with metadata
+// describing the failure. This works with any of the engines supported by NewPubClient.
+type DeadLetterPublisher struct {
+	clt           *PubClient
+	originalTopic string
+}
+
+// NewDeadLetterPublisher returns an initialized publisher for the DeadLetterTopicName of the given broker config.
+func NewDeadLetterPublisher(
+	logger *zap.SugaredLogger, broker *Broker, ctx context.Context,
+) (*DeadLetterPublisher, error) {
+	if broker.DeadLetterTopicName == "" {
+		return nil, fmt.Errorf("Broker has no dead-letter topic configured")
+	}
+
+	clt, err := NewPubClient(logger, broker.withTopic(broker.DeadLetterTopicName), ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetterPublisher{
+		clt:           clt,
+		originalTopic: broker.TopicName,
+	}, nil
+}
+
+// Close will close all the associated connections of the dead-letter publisher.
+func (p *DeadLetterPublisher) Close() error {
+	if p == nil {
+		return nil
+	}
+	return p.clt.Close()
+}
+
+// Publish sends a copy of the given received message to the dead-letter topic, recording the task error, the attempt
+// count, the original topic and the time of failure in the message metadata. The caller is responsible for acking the
+// original message once this succeeds.
+func (p *DeadLetterPublisher) Publish(ctx context.Context, msg *pubsub.Message, taskErr error) error {
+	dlMsg := copyMsgForResend(msg, msgAttempt(msg))
+	if taskErr != nil {
+		dlMsg.Metadata[MetadataKeyDeadLetterError] = taskErr.Error()
+	}
+	dlMsg.Metadata[MetadataKeyDeadLetterTopic] = p.originalTopic
+	dlMsg.Metadata[MetadataKeyDeadLetterTime] = time.Now().UTC().Format(time.RFC3339)
+	return p.clt.sendMsg(ctx, dlMsg)
+}
+
+// ReplayOptions represents options for replaying tasks from the dead-letter topic with ReplayDeadLetters.
+type ReplayOptions struct {
+	// Filter is called on each message read from the dead-letter topic to select which messages should be replayed. The
+	// failure metadata (e.g., MetadataKeyDeadLetterError) can be used to inspect why the task failed. When nil, all
+	// messages are replayed.
+	Filter func(msg *pubsub.Message) bool
+
+	// MaxMessages is the maximum number of messages to read from the dead-letter topic. When 0, messages are read until
+	// the dead-letter topic is idle.
+	MaxMessages int
+
+	// IdleTimeout is how long to wait for a new message before deciding the dead-letter topic is drained. Defaults to 5
+	// seconds.
+	IdleTimeout time.Duration
+
+	// ServiceBusSubscriptionName is the Azure ServiceBus Topic Subscription on the dead-letter topic to read from. If
+	// blank, assume that the dead-letter topic is an Azure ServiceBus Queue. This is only used with Azure ServiceBus.
+	ServiceBusSubscriptionName string
+}
+
+// ReplayResult summarizes the outcome of ReplayDeadLetters.
+type ReplayResult struct {
+	// Replayed is the number of messages that were resent to their original topic and removed from the dead-letter
+	// topic.
+	Replayed int
+
+	// Skipped is the number of distinct messages that were not selected by the filter and were returned to the
+	// dead-letter topic.
+	Skipped int
+}
+
+// replayLockRenewalInterval is how often ReplayDeadLetters renews the locks on the skipped messages that it holds, when
+// the broker has no LockRenewalInterval.
+const replayLockRenewalInterval = 10 * time.Second
+
+// ReplayDeadLetters reads the tasks from the DeadLetterTopicName of the given broker config, and resends the messages
+// selected by the filter to the topic they were originally published on. Replayed messages have the failure metadata
+// removed and the attempt count reset, so that they are retried from scratch.
+//
+// Messages that are not selected are held (renewing their locks on Azure ServiceBus) until the replay completes, and are
+// then nacked so that they remain in the dead-letter topic. Holding them keeps the broker from delivering them again
+// ahead of the rest of the dead-letter topic, as Azure ServiceBus and RabbitMQ return a nacked message to the head of
+// the queue. Messages are identified by their body and metadata, so a message that is received again (e.g., after its
+// lock expired) is nacked and not counted twice. The replay stops once the dead-letter topic is idle for IdleTimeout,
+// or once as many messages were received again as there are distinct messages, in case the broker keeps redelivering
+// them.
+func ReplayDeadLetters(
+	ctx context.Context, logger *zap.SugaredLogger, broker *Broker, opts ReplayOptions,
+) (result ReplayResult, returnErr error) {
+	if broker.DeadLetterTopicName == "" {
+		return result, fmt.Errorf("Broker has no dead-letter topic configured")
+	}
+	idleTimeout := opts.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = 5 * time.Second
+	}
+
+	deadLetterBroker := broker.withTopic(broker.DeadLetterTopicName)
+	deadLetterBroker.ServiceBusSubscriptionName = opts.ServiceBusSubscriptionName
+	deadLetterBroker.DeadLetterTopicName = ""
+	subClt, err := NewSubClient(logger, deadLetterBroker, ctx)
+	if err != nil {
+		return result, err
+	}
+
+	pubClts := map[string]*PubClient{}
+	var skipped []*pubsub.Message
+	var stopKeepAlives []func()
+	defer func() {
+		for _, stop := range stopKeepAlives {
+			stop()
+		}
+		for _, msg := range skipped {
+			nackMsg(logger, msg)
+		}
+		for topic, pubClt := range pubClts {
+			if err := pubClt.Close(); err != nil {
+				logger.Errorf("Error closing publisher for topic %s: %s", topic, err)
+				if returnErr == nil {
+					returnErr = err
+				}
+			}
+		}
+		if err := subClt.Close(); err != nil {
+			logger.Errorf("Error closing dead-letter subscription: %s", err)
+			if returnErr == nil {
+				returnErr = err
+			}
+		}
+	}()
+
+	lockRenewalInterval := broker.LockRenewalInterval
+	if lockRenewalInterval <= 0 {
+		lockRenewalInterval = replayLockRenewalInterval
+	}
+
+	// seen records the keys of the messages that were received, to detect the messages that are delivered again.
+	seen := map[string]bool{}
+	repeats := 0
+	for opts.MaxMessages <= 0 || result.Replayed+result.Skipped < opts.MaxMessages {
+		receiveCtx, cancel := context.WithTimeout(ctx, idleTimeout)
+		msg, err := subClt.receive(receiveCtx)
+		cancel()
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				logger.Debugf("No more messages in dead-letter topic")
+				return result, nil
+			}
+			return result, err
+		}
+
+		key := replayKey(msg)
+		if seen[key] {
+			nackMsg(logger, msg)
+			repeats++
+			logger.Debugf("Received message %s again. Skipping.", msg.LoggableID)
+			if repeats >= len(seen) {
+				logger.Debugf("Dead-letter topic keeps delivering messages that were already read. Stopping.")
+				return result, nil
+			}
+			continue
+		}
+		seen[key] = true
+
+		if opts.Filter != nil && !opts.Filter(msg) {
+			_, stop := subClt.keepAlive(msg, lockRenewalInterval, 0)
+			stopKeepAlives = append(stopKeepAlives, stop)
+			skipped = append(skipped, msg)
+			result.Skipped++
+			continue
+		}
+
+		topic := msg.Metadata[MetadataKeyDeadLetterTopic]
+		if topic == "" {
+			topic = broker.TopicName
+		}
+		pubClt, hasClt := pubClts[topic]
+		if !hasClt {
+			pubClt, err = NewPubClient(logger, broker.withTopic(topic), ctx)
+			if err != nil {
+				nackMsg(logger, msg)
+				return result, err
+			}
+			pubClts[topic] = pubClt
+		}
+
+		replayMsg := copyMsgForResend(msg, 1)
+		delete(replayMsg.Metadata, MetadataKeyDeadLetterError)
+		delete(replayMsg.Metadata, MetadataKeyDeadLetterTopic)
+		delete(replayMsg.Metadata, MetadataKeyDeadLetterTime)
+		if err := pubClt.sendMsg(ctx, replayMsg); err != nil {
+			nackMsg(logger, msg)
+			return result, err
+		}
+		msg.Ack()
+		result.Replayed++
+		logger.Infof("Replayed dead-lettered message %s to topic %s", msg.LoggableID, topic)
+	}
+	return result, nil
+}
+
+// replayKey returns the key that identifies a message read from the dead-letter topic across redeliveries, which is a
+// hash of its body and metadata. The delivery counts are left out, as they change with each delivery.
+func replayKey(msg *pubsub.Message) string {
+	keys := make([]string, 0, len(msg.Metadata))
+	for k := range msg.Metadata {
+		if k != MetadataKeyDeliveryCount && k != rabbitMQDeliveryCountHeader {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%q=%q\n", k, msg.Metadata[k])
+	}
+	h.Write(msg.Body)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,76 @@
+package workerstd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"gocloud.dev/pubsub"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestReplayDeadLetters(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	broker := newTestMemBroker(t, "tasks")
+	broker.DeadLetterTopicName = "tasks-dlq"
+
+	dlClt, err := NewPubClient(logger, broker.withTopic(broker.DeadLetterTopicName), context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dlClt.Close()
+	for _, value := range []string{"skip", "replay"} {
+		if err := dlClt.SendTaskCtx(context.Background(), wrapperspb.String(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A message that was not sent by a PubClient has no message ID, and must be skipped without looping on it.
+	noID := &pubsub.Message{Body: []byte("raw"), Metadata: map[string]string{"kind": "raw"}}
+	if err := dlClt.sendMsg(context.Background(), noID); err != nil {
+		t.Fatal(err)
+	}
+
+	onlyReplay := func(msg *pubsub.Message) bool {
+		task := &wrapperspb.StringValue{}
+		return decodeTask(msg, task) == nil && task.GetValue() == "replay"
+	}
+	result, err := ReplayDeadLetters(context.Background(), logger, broker, ReplayOptions{
+		Filter:      onlyReplay,
+		IdleTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ReplayResult{Replayed: 1, Skipped: 2}); result != want {
+		t.Errorf("Replay result %+v, want %+v", result, want)
+	}
+
+	subClt, err := NewSubClient(logger, broker, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subClt.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	task, msg, err := receiveStringTask(ctx, subClt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Ack()
+	if got := task.(*wrapperspb.StringValue).GetValue(); got != "replay" {
+		t.Errorf("Replayed task %q, want %q", got, "replay")
+	}
+
+	// The skipped messages are left in the dead-letter topic.
+	result, err = ReplayDeadLetters(context.Background(), logger, broker, ReplayOptions{
+		Filter:      func(*pubsub.Message) bool { return false },
+		IdleTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ReplayResult{Skipped: 2}); result != want {
+		t.Errorf("Second replay result %+v, want %+v", result, want)
+	}
+}
@@ -0,0 +1,110 @@
+package workerstd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gocloud.dev/pubsub"
+)
+
+// builtinEngines are the engines that are implemented directly by the PubClient and SubClient. These names can not be
+// registered with RegisterEngine.
+var builtinEngines = map[string]bool{
+	"azuresb":  true,
+	"rabbitmq": true,
+	"mem":      true,
+}
+
+var (
+	enginesMu sync.RWMutex
+	engines   = map[string]Engine{}
+)
+
+// Engine opens the gocloud topics and subscriptions of a message broker, so that the broker can be used with the
+// PubClient and SubClient by registering the engine with RegisterEngine. The engine reads its configuration from the
+// Broker.
+//
+// The close functions that are returned along with the topic and subscription release the connections that were opened
+// for them, and are called after the topic or subscription is shut down. They may be nil if there is nothing to
+// release.
+type Engine interface {
+	OpenTopic(ctx context.Context, logger *zap.SugaredLogger, broker *Broker) (*pubsub.Topic, func() error, error)
+	OpenSubscription(
+		ctx context.Context, logger *zap.SugaredLogger, broker *Broker,
+	) (*pubsub.Subscription, func() error, error)
+}
+
+// DelayedNackEngine is implemented by the registered engines whose brokers can redeliver a nacked message once a delay
+// has elapsed (e.g., NATS JetStream). The RetryPolicy is only supported with the registered engines that implement this
+// interface, as the workers retry the failed tasks by nacking their message with the backoff of the RetryPolicy.
+type DelayedNackEngine interface {
+	Engine
+
+	// NackWithDelay nacks a message that was received from a subscription of the engine, so that the broker redelivers
+	// it once the delay has elapsed. This is used in place of pubsub.Message.Nack.
+	NackWithDelay(msg *pubsub.Message, delay time.Duration) error
+}
+
+// RegisterEngine registers the engine under the given name, so that it can be selected with the Engine field of the
+// Broker. Registering a name that is already registered replaces the previous engine. This panics if the name is one of
+// the built-in engines (azuresb, rabbitmq, or mem).
+func RegisterEngine(name string, engine Engine) {
+	if builtinEngines[name] {
+		panic(fmt.Sprintf("workerstd: can not register built-in engine %s", name))
+	}
+
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+	engines[name] = engine
+}
+
+// lookupEngine returns the registered engine with the given name.
+func lookupEngine(name string) (Engine, error) {
+	enginesMu.RLock()
+	defer enginesMu.RUnlock()
+	engine, exists := engines[name]
+	if !exists {
+		return nil, fmt.Errorf("Unknown engine %s", name)
+	}
+	return engine, nil
+}
+
+func newEnginePublisherClient(
+	logger *zap.SugaredLogger, broker *Broker, ctx context.Context,
+) (*PubClient, error) {
+	engine, err := lookupEngine(broker.Engine)
+	if err != nil {
+		return nil, err
+	}
+	topic, closeFn, err := engine.OpenTopic(ctx, logger, broker)
+	if err != nil {
+		return nil, err
+	}
+	return &PubClient{
+		topic:       topic,
+		logger:      logger,
+		ctx:         ctx,
+		closeEngine: closeFn,
+	}, nil
+}
+
+func newEngineSubscriberClient(
+	logger *zap.SugaredLogger, broker *Broker, ctx context.Context,
+) (*SubClient, error) {
+	engine, err := lookupEngine(broker.Engine)
+	if err != nil {
+		return nil, err
+	}
+	subscription, closeFn, err := engine.OpenSubscription(ctx, logger, broker)
+	if err != nil {
+		return nil, err
+	}
+	return &SubClient{
+		subscription: subscription,
+		logger:       logger,
+		closeEngine:  closeFn,
+	}, nil
+}
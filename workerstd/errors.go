@@ -0,0 +1,84 @@
+package workerstd
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrRetryable can be returned by a task handler to indicate that the task failed with a transient error and should
+	// be redelivered by the broker. Note that when AutoAck is enabled, this is the default treatment of any error that
+	// does not wrap ErrPermanent.
+	ErrRetryable = errors.New("Retryable task error")
+
+	// ErrPermanent can be returned by a task handler to indicate that the task failed with an error that will not go away
+	// on redelivery. When AutoAck is enabled, messages for tasks that fail with this error are dead-lettered.
+	ErrPermanent = errors.New("Permanent task error")
+
+	// ErrBrokerUnavailable is returned by the publisher and subscriber clients when the connection to the broker is
+	// temporarily unavailable, such as while reconnecting to RabbitMQ. The operation can be retried once the connection
+	// is reestablished.
+	ErrBrokerUnavailable = errors.New("Broker is temporarily unavailable")
+
+	// ErrMalformedMessage is returned by the subscriber client when a received message can not be decoded into a task,
+	// such as when the message has an unknown type or the body fails to unmarshal. These messages are dead-lettered by
+	// the subscriber client, and the worker skips them and continues processing other messages.
+	ErrMalformedMessage = errors.New("Malformed message")
+
+	// ErrFatal is returned by the subscriber client when the subscription fails with an error that it can not recover
+	// from. The worker stops when it encounters this error.
+	ErrFatal = errors.New("Fatal broker error")
+)
+
+// kindError wraps an error with one of the sentinel errors to classify it (e.g., to determine how the message should be
+// settled), while still preserving the original error chain.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return fmt.Sprintf("%s: %s", e.kind, e.err)
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// Retryable wraps the given error so that it matches ErrRetryable with errors.Is. Returns nil if err is nil.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{kind: ErrRetryable, err: err}
+}
+
+// Permanent wraps the given error so that it matches ErrPermanent with errors.Is. Returns nil if err is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{kind: ErrPermanent, err: err}
+}
+
+// PanicError is the error that is reported when a task handler panics. The panic is treated as a permanent failure of
+// the task, so this matches ErrPermanent with errors.Is.
+type PanicError struct {
+	// Value is the value that was passed to panic.
+	Value interface{}
+
+	// Stack is the stack trace of the goroutine at the time of the panic.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Task handler panicked: %v", e.Value)
+}
+
+func (e *PanicError) Is(target error) bool {
+	return target == ErrPermanent
+}
@@ -0,0 +1,268 @@
+package workerstd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gocloud.dev/pubsub"
+)
+
+// DefaultLivenessTimeout is how long the receive loop can go without ticking before the worker is reported as unhealthy,
+// when App.LivenessTimeout is not set.
+const DefaultLivenessTimeout = 1 * time.Minute
+
+// workerHealth tracks the liveness and readiness of a running worker, and records the task metrics. When the App has a
+// HealthPort, these are served over HTTP on /healthz, /readyz and /metrics.
+type workerHealth struct {
+	app           *App
+	subscriptions []*SubClient
+	metrics       *workerMetrics
+	registry      *prometheus.Registry
+
+	// lastTick is the time (in unix nanoseconds) at which the receive loop last ticked.
+	lastTick atomic.Int64
+	running  atomic.Bool
+
+	// brokerUnavailable records the names of the subscriptions for which the last receive from the broker failed
+	// because the broker was unavailable.
+	brokerUnavailableMu sync.Mutex
+	brokerUnavailable   map[string]bool
+
+	srv     *http.Server
+	srvDone chan struct{}
+	srvErr  error
+}
+
+// workerMetrics are the Prometheus metrics of the tasks processed by the worker.
+type workerMetrics struct {
+	received  *prometheus.CounterVec
+	succeeded *prometheus.CounterVec
+	failed    *prometheus.CounterVec
+	panicked  *prometheus.CounterVec
+	limited   *prometheus.CounterVec
+	latency   *prometheus.HistogramVec
+	inFlight  prometheus.Gauge
+}
+
+// newWorkerHealth returns the health tracker for a worker App receiving from the given subscribers. The metrics are
+// registered on the App MetricsRegistry if set, or a new registry otherwise.
+func newWorkerHealth(app *App, subscribers []*subscriber) (*workerHealth, error) {
+	registry := app.MetricsRegistry
+	if registry == nil {
+		registry = prometheus.NewRegistry()
+		registry.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+
+	metrics := &workerMetrics{
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "workerstd",
+			Name:      "tasks_received_total",
+			Help:      "Number of tasks received from the broker.",
+		}, []string{"task"}),
+		succeeded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "workerstd",
+			Name:      "tasks_succeeded_total",
+			Help:      "Number of tasks for which the handler returned nil.",
+		}, []string{"task"}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "workerstd",
+			Name:      "tasks_failed_total",
+			Help:      "Number of tasks for which the handler returned an error, including panics.",
+		}, []string{"task"}),
+		panicked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "workerstd",
+			Name:      "tasks_panicked_total",
+			Help:      "Number of tasks for which the handler panicked.",
+		}, []string{"task"}),
+		limited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "workerstd",
+			Name:      "tasks_rate_limited_total",
+			Help:      "Number of tasks that were delayed or requeued for being over the rate limits.",
+		}, []string{"task"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "workerstd",
+			Name:      "task_handler_duration_seconds",
+			Help:      "Duration of the task handler calls.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"task"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "workerstd",
+			Name:      "tasks_in_flight",
+			Help:      "Number of tasks that are currently being processed.",
+		}),
+	}
+	for _, c := range []prometheus.Collector{
+		metrics.received, metrics.succeeded, metrics.failed, metrics.panicked, metrics.limited, metrics.latency, metrics.inFlight,
+	} {
+		if err := registry.Register(c); err != nil {
+			return nil, fmt.Errorf("Error registering worker metrics: %w", err)
+		}
+	}
+
+	h := &workerHealth{
+		app:               app,
+		metrics:           metrics,
+		registry:          registry,
+		brokerUnavailable: map[string]bool{},
+	}
+	for _, s := range subscribers {
+		h.subscriptions = append(h.subscriptions, s.client)
+	}
+	h.tick()
+	return h, nil
+}
+
+// tick records that the receive loop is making progress. Waiting for a free slot in the task pool also counts as
+// progress, so that a worker whose slots are all held by long running tasks is not reported as unhealthy.
+func (h *workerHealth) tick() {
+	h.lastTick.Store(time.Now().UnixNano())
+}
+
+// setRunning records whether the receive loop is running.
+func (h *workerHealth) setRunning(running bool) {
+	h.tick()
+	h.running.Store(running)
+}
+
+// setBrokerAvailable records whether the last receive from the broker of the named subscription succeeded.
+func (h *workerHealth) setBrokerAvailable(subscription string, available bool) {
+	h.brokerUnavailableMu.Lock()
+	defer h.brokerUnavailableMu.Unlock()
+	if available {
+		delete(h.brokerUnavailable, subscription)
+		return
+	}
+	h.brokerUnavailable[subscription] = true
+}
+
+// observeTask records the metrics for a task that was received from the broker and dispatched to the handler. The
+// returned function must be called with the result of the handler when it returns.
+func (h *workerHealth) observeTask(msg *pubsub.Message) func(err error) {
+	task := msg.Metadata[MetadataKeyTaskName]
+	h.metrics.received.WithLabelValues(task).Inc()
+	h.metrics.inFlight.Inc()
+	start := time.Now()
+
+	return func(err error) {
+		h.metrics.inFlight.Dec()
+		h.metrics.latency.WithLabelValues(task).Observe(time.Since(start).Seconds())
+
+		var panicErr *PanicError
+		switch {
+		case err == nil:
+			h.metrics.succeeded.WithLabelValues(task).Inc()
+		case errors.As(err, &panicErr):
+			h.metrics.panicked.WithLabelValues(task).Inc()
+			h.metrics.failed.WithLabelValues(task).Inc()
+		default:
+			h.metrics.failed.WithLabelValues(task).Inc()
+		}
+
+		// NOTE: a completed task frees a slot in the task pool, which unblocks the receive loop. Count that as progress so
+		// that long running tasks that keep all the slots busy don't fail the liveness check.
+		h.tick()
+	}
+}
+
+// observeRateLimited records the metrics for a task that was over the rate limits.
+func (h *workerHealth) observeRateLimited(msg *pubsub.Message) {
+	h.metrics.limited.WithLabelValues(msg.Metadata[MetadataKeyTaskName]).Inc()
+}
+
+// isAlive returns whether the receive loop ticked within the liveness timeout.
+func (h *workerHealth) isAlive() bool {
+	timeout := h.app.LivenessTimeout
+	if timeout <= 0 {
+		timeout = DefaultLivenessTimeout
+	}
+	return time.Since(time.Unix(0, h.lastTick.Load())) < timeout
+}
+
+// isReady returns whether the worker is running and connected to the brokers of all the subscriptions.
+func (h *workerHealth) isReady() bool {
+	if !h.running.Load() {
+		return false
+	}
+
+	h.brokerUnavailableMu.Lock()
+	unavailable := len(h.brokerUnavailable) > 0
+	h.brokerUnavailableMu.Unlock()
+	if unavailable {
+		return false
+	}
+
+	for _, subscription := range h.subscriptions {
+		if !subscription.isConnected() {
+			return false
+		}
+	}
+	return true
+}
+
+// handler returns the HTTP handler that serves the health endpoints and metrics.
+func (h *workerHealth) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", probeHandler(h.isAlive))
+	mux.HandleFunc("/readyz", probeHandler(h.isReady))
+	mux.Handle("/metrics", promhttp.HandlerFor(h.registry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+// probeHandler returns an HTTP handler that responds with 200 when the given check passes, and 503 otherwise.
+func probeHandler(check func() bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !check() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// serve starts the health HTTP listener in the background, if the App has a HealthPort.
+func (h *workerHealth) serve() {
+	if h.app.HealthPort == 0 {
+		return
+	}
+
+	h.srv = &http.Server{
+		Addr:              fmt.Sprintf(":%d", h.app.HealthPort),
+		Handler:           h.handler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	h.srvDone = make(chan struct{})
+	go func() {
+		defer close(h.srvDone)
+		h.app.Logger.Debugf("Starting health server on %s", h.srv.Addr)
+		if err := h.srv.ListenAndServe(); err != http.ErrServerClosed {
+			h.app.Logger.Errorf("Error running health server: %s", err)
+			h.srvErr = err
+		}
+	}()
+}
+
+// Close shuts down the health HTTP listener, if it was started.
+func (h *workerHealth) Close() error {
+	if h.srv == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.srv.Shutdown(ctx); err != nil {
+		return err
+	}
+	<-h.srvDone
+	return h.srvErr
+}
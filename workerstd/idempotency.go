@@ -0,0 +1,123 @@
+package workerstd
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gocloud.dev/pubsub"
+)
+
+// DefaultIdempotencyWindow is how long the worker remembers completed tasks when App.IdempotencyWindow is not set.
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// IdempotencyStore records which tasks have completed successfully, keyed on the name of the Subscription that the task
+// was received from and the message ID that the PubClient stamps into the MetadataKeyMessageID metadata (e.g.,
+// "emails/<message ID>"). The worker consults the store before dispatching a task, so that a task that is redelivered
+// by the broker after it already completed is skipped instead of processed again. The subscription name is part of the
+// key so that the subscriptions of the same topic each process the task once.
+//
+// MemoryIdempotencyStore only deduplicates within a single worker process. To deduplicate across worker replicas and
+// restarts, implement this interface on top of a persistent store (e.g., Redis or a SQL table with an expiry column).
+type IdempotencyStore interface {
+	// IsDone returns whether the task with the given key has completed successfully, and the record has not expired
+	// yet.
+	IsDone(ctx context.Context, key string) (bool, error)
+
+	// MarkDone records that the task with the given key has completed successfully. The record only needs to be kept
+	// for the given window, after which the task may be processed again.
+	MarkDone(ctx context.Context, key string, window time.Duration) error
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore that keeps the completed tasks in memory. Expired records are swept
+// on MarkDone, so the memory use is bounded by the number of tasks completed within the window.
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	expiresAt map[string]time.Time
+	nextSweep time.Time
+}
+
+var _ IdempotencyStore = (*MemoryIdempotencyStore)(nil)
+
+// NewMemoryIdempotencyStore returns an empty in-memory IdempotencyStore.
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		expiresAt: map[string]time.Time{},
+	}
+}
+
+// IsDone implements IdempotencyStore.
+func (s *MemoryIdempotencyStore) IsDone(_ context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiresAt, ok := s.expiresAt[key]
+	return ok && time.Now().Before(expiresAt), nil
+}
+
+// MarkDone implements IdempotencyStore.
+func (s *MemoryIdempotencyStore) MarkDone(_ context.Context, key string, window time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.expiresAt[key] = now.Add(window)
+
+	// Sweeping is linear in the number of records, so only do it once per window.
+	if now.After(s.nextSweep) {
+		for key, expiresAt := range s.expiresAt {
+			if !now.Before(expiresAt) {
+				delete(s.expiresAt, key)
+			}
+		}
+		s.nextSweep = now.Add(window)
+	}
+	return nil
+}
+
+// idempotencyKey returns the key of the given message in the IdempotencyStore, or an empty string if the message has
+// no message ID.
+func idempotencyKey(sub *Subscription, msg *pubsub.Message) string {
+	messageID := msg.Metadata[MetadataKeyMessageID]
+	if messageID == "" {
+		return ""
+	}
+	return sub.Name + "/" + messageID
+}
+
+// isDuplicate returns whether the given message is a redelivery of a task that already completed successfully on the
+// given subscription, according to the IdempotencyStore of the worker. Errors from the store are logged and treated as
+// not done, so that an unavailable store degrades to at-least-once processing instead of dropping tasks.
+func (w *worker) isDuplicate(sub *Subscription, msg *pubsub.Message) bool {
+	store := w.app.IdempotencyStore
+	key := idempotencyKey(sub, msg)
+	if store == nil || key == "" {
+		return false
+	}
+
+	done, err := store.IsDone(w.ctx, key)
+	if err != nil {
+		w.app.Logger.Warnf("Error checking idempotency store for task %s: %s", key, err)
+		return false
+	}
+	return done
+}
+
+// markDone records the given message as completed on the given subscription in the IdempotencyStore of the worker, if
+// any.
+func (w *worker) markDone(sub *Subscription, msg *pubsub.Message) {
+	store := w.app.IdempotencyStore
+	key := idempotencyKey(sub, msg)
+	if store == nil || key == "" {
+		return
+	}
+
+	window := w.app.IdempotencyWindow
+	if window <= 0 {
+		window = DefaultIdempotencyWindow
+	}
+	// NOTE: use a fresh context so that the record is not lost when the worker is shutting down right after the task
+	// completed.
+	if err := store.MarkDone(context.Background(), key, window); err != nil {
+		w.app.Logger.Errorf("Error recording task %s in idempotency store: %s", key, err)
+	}
+}
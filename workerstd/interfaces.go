@@ -1,11 +1,37 @@
 package workerstd
 
 import (
+	"context"
+
 	"gocloud.dev/pubsub"
 	"google.golang.org/protobuf/proto"
 )
 
-// TaskHandler is the interface that task handlers passed to the worker app should implement.
+// TaskHandler is the interface that task handlers passed to the worker app should implement. Unless AutoAck is enabled
+// on the App, the handler is responsible for calling Ack or Nack on the message. When AutoAck is enabled, the handler
+// must not Ack or Nack the message, and should instead return an error wrapping ErrPermanent or ErrRetryable to
+// control how the failed message is settled.
 type TaskHandler interface {
 	HandleTaskMsg(proto.Message, *pubsub.Message) error
 }
+
+// ContextTaskHandler is the context-aware variant of TaskHandler. The context passed to the handler is cancelled when
+// the worker is shutting down (App.Lifecycle is shut down), and carries the per-task deadline configured with
+// App.TaskTimeout. The same rules as TaskHandler apply for acknowledging the message.
+type ContextTaskHandler interface {
+	HandleTaskMsgCtx(context.Context, proto.Message, *pubsub.Message) error
+}
+
+// AdaptTaskHandler returns a ContextTaskHandler that calls the given TaskHandler, ignoring the context.
+func AdaptTaskHandler(handler TaskHandler) ContextTaskHandler {
+	return taskHandlerAdapter{handler: handler}
+}
+
+// taskHandlerAdapter adapts a TaskHandler to the ContextTaskHandler interface.
+type taskHandlerAdapter struct {
+	handler TaskHandler
+}
+
+func (a taskHandlerAdapter) HandleTaskMsgCtx(_ context.Context, task proto.Message, msg *pubsub.Message) error {
+	return a.handler.HandleTaskMsg(task, msg)
+}
@@ -0,0 +1,3 @@
+// Package workertest contains the helpers that are shared by the tests of workerstd and its engines, for running a
+// worker in the background and collecting the tasks that it processed.
+package workertest
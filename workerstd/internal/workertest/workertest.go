@@ -0,0 +1,61 @@
+package workertest
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stopTimeout is how long the stop function of Run waits for the worker to return.
+const stopTimeout = 15 * time.Second
+
+// Run calls the given run function (e.g., the Run method of a workerstd.App) in the background, and returns a function
+// that cancels its context and returns the error that it returned. The stop function is safe to call multiple times,
+// and is also called when the test completes, so that the worker does not outlive a test that failed early.
+func Run(t *testing.T, run func(ctx context.Context) error) (stop func() error) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- run(ctx)
+	}()
+
+	var once sync.Once
+	var err error
+	stop = func() error {
+		once.Do(func() {
+			cancel()
+			select {
+			case err = <-errCh:
+			case <-time.After(stopTimeout):
+				err = errors.New("Timed out waiting for the worker to stop")
+			}
+		})
+		return err
+	}
+	t.Cleanup(func() { _ = stop() })
+	return stop
+}
+
+// CollectSorted receives n values from the given channel, and returns them sorted. This fails the test if the values
+// are not received within the timeout.
+func CollectSorted(t *testing.T, ch <-chan string, n int, timeout time.Duration) []string {
+	t.Helper()
+
+	var received []string
+	timeoutCh := time.After(timeout)
+	for len(received) < n {
+		select {
+		case value := <-ch:
+			received = append(received, value)
+		case <-timeoutCh:
+			t.Fatalf("Timed out waiting for tasks. Received: %v", received)
+		}
+	}
+	sort.Strings(received)
+	return received
+}
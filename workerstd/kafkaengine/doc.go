@@ -0,0 +1,9 @@
+// Package kafkaengine registers the kafka engine for workerstd, which uses the gocloud Kafka driver. Import this
+// package for its side effects to enable the engine:
+//
+//	import _ "github.com/illumitacit/gostd/workerstd/kafkaengine"
+//
+// The engine is configured with the Kafka field of the workerstd.Broker. Note that Kafka does not support Nack, so
+// failed tasks can not be retried (a RetryPolicy with more than 1 attempt is rejected when the worker starts), and
+// should be handled with a DeadLetterTopicName on the broker.
+package kafkaengine
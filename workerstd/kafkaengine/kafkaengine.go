@@ -0,0 +1,83 @@
+package kafkaengine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/kafkapubsub"
+
+	"github.com/illumitacit/gostd/workerstd"
+)
+
+// EngineName is the name of the engine in the Engine field of the workerstd.Broker.
+const EngineName = "kafka"
+
+func init() {
+	workerstd.RegisterEngine(EngineName, Engine{})
+}
+
+// Engine is the workerstd.Engine for Kafka.
+type Engine struct{}
+
+var _ workerstd.Engine = Engine{}
+
+// OpenTopic implements workerstd.Engine.
+func (Engine) OpenTopic(
+	_ context.Context, _ *zap.SugaredLogger, broker *workerstd.Broker,
+) (*pubsub.Topic, func() error, error) {
+	config, err := saramaConfig(broker)
+	if err != nil {
+		return nil, nil, err
+	}
+	topic, err := kafkapubsub.OpenTopic(broker.Kafka.Brokers, config, broker.TopicName, &kafkapubsub.TopicOptions{
+		BatcherOptions: broker.PublishBatching.BatcherOptions(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return topic, nil, nil
+}
+
+// OpenSubscription implements workerstd.Engine.
+func (Engine) OpenSubscription(
+	_ context.Context, _ *zap.SugaredLogger, broker *workerstd.Broker,
+) (*pubsub.Subscription, func() error, error) {
+	config, err := saramaConfig(broker)
+	if err != nil {
+		return nil, nil, err
+	}
+	group := broker.Kafka.ConsumerGroup
+	if group == "" {
+		group = broker.TopicName
+	}
+	subscription, err := kafkapubsub.OpenSubscription(
+		broker.Kafka.Brokers, config, group, []string{broker.TopicName}, nil,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return subscription, nil, nil
+}
+
+// saramaConfig returns the Kafka client config for the broker.
+func saramaConfig(broker *workerstd.Broker) (*sarama.Config, error) {
+	if broker.Kafka == nil || len(broker.Kafka.Brokers) == 0 {
+		return nil, fmt.Errorf("Kafka brokers are required for the %s engine", EngineName)
+	}
+
+	config := kafkapubsub.MinimalConfig()
+	if broker.Kafka.Version != "" {
+		version, err := sarama.ParseKafkaVersion(broker.Kafka.Version)
+		if err != nil {
+			return nil, err
+		}
+		if !version.IsAtLeast(sarama.V0_11_0_0) {
+			return nil, fmt.Errorf("Kafka version %s is not supported, as it does not support message headers", version)
+		}
+		config.Version = version
+	}
+	return config, nil
+}
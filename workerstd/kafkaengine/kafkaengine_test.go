@@ -0,0 +1,166 @@
+package kafkaengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+	"gocloud.dev/pubsub"
+
+	"github.com/illumitacit/gostd/quit"
+	"github.com/illumitacit/gostd/workerstd"
+)
+
+const (
+	testTopic = "tasks"
+	testGroup = "workers"
+)
+
+// newTestBroker returns a mock Kafka broker that serves a single partition of the test topic, with the given message
+// available at offset 0, to a single member of the test consumer group.
+func newTestBroker(t *testing.T, body string) *sarama.MockBroker {
+	t.Helper()
+	mock := sarama.NewMockBroker(t, 1)
+	t.Cleanup(mock.Close)
+	mock.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(mock.Addr(), mock.BrokerID()).
+			SetLeader(testTopic, 0, mock.BrokerID()),
+		// NOTE: kafkapubsub.MinimalConfig targets Kafka 0.11, which sends version 3 produce requests.
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(3),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset(testTopic, 0, sarama.OffsetOldest, 0).
+			SetOffset(testTopic, 0, sarama.OffsetNewest, 1),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, testGroup, mock),
+		"HeartbeatRequest": sarama.NewMockHeartbeatResponse(t),
+		"JoinGroupRequest": sarama.NewMockJoinGroupResponse(t).
+			SetGroupProtocol(sarama.RangeBalanceStrategyName),
+		"SyncGroupRequest": sarama.NewMockSyncGroupResponse(t).SetMemberAssignment(
+			&sarama.ConsumerGroupMemberAssignment{
+				Topics: map[string][]int32{testTopic: {0}},
+			}),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset(testGroup, testTopic, 0, 0, "", sarama.ErrNoError),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+		"LeaveGroupRequest":   sarama.NewMockLeaveGroupResponse(t),
+		"FetchRequest": sarama.NewMockSequence(
+			sarama.NewMockFetchResponse(t, 1).SetMessage(testTopic, 0, 0, sarama.StringEncoder(body)),
+			sarama.NewMockFetchResponse(t, 1),
+		),
+	})
+	return mock
+}
+
+func newTestBrokerConfig(mock *sarama.MockBroker) *workerstd.Broker {
+	return &workerstd.Broker{
+		Engine:    EngineName,
+		TopicName: testTopic,
+		Kafka: &workerstd.KafkaConfig{
+			Brokers:       []string{mock.Addr()},
+			ConsumerGroup: testGroup,
+		},
+	}
+}
+
+func TestOpenSubscription(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	mock := newTestBroker(t, "hello")
+
+	subscription, closeFn, err := Engine{}.OpenSubscription(context.Background(), logger, newTestBrokerConfig(mock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := subscription.Shutdown(context.Background()); err != nil {
+			t.Errorf("Error shutting down subscription: %s", err)
+		}
+		if closeFn != nil {
+			if err := closeFn(); err != nil {
+				t.Errorf("Error closing engine: %s", err)
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	msg, err := subscription.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Ack()
+	if got := string(msg.Body); got != "hello" {
+		t.Errorf("Received message body %q, want %q", got, "hello")
+	}
+}
+
+func TestRunRejectsRetries(t *testing.T) {
+	mock := newTestBroker(t, "")
+	broker := newTestBrokerConfig(mock)
+	broker.RetryPolicy = &workerstd.RetryPolicy{MaxAttempts: 3}
+	app := &workerstd.App{
+		Broker:    broker,
+		Logger:    zap.NewNop().Sugar(),
+		Lifecycle: quit.New(),
+	}
+	if err := app.Run(context.Background()); err == nil {
+		t.Error("Expected an error for a RetryPolicy that Kafka can not redeliver tasks for")
+	}
+}
+
+func TestOpenTopic(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	mock := newTestBroker(t, "")
+
+	topic, closeFn, err := Engine{}.OpenTopic(context.Background(), logger, newTestBrokerConfig(mock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := topic.Shutdown(context.Background()); err != nil {
+			t.Errorf("Error shutting down topic: %s", err)
+		}
+		if closeFn != nil {
+			if err := closeFn(); err != nil {
+				t.Errorf("Error closing engine: %s", err)
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = topic.Send(ctx, &pubsub.Message{
+		Body:     []byte("hello"),
+		Metadata: map[string]string{workerstd.MetadataKeyType: workerstd.MetadataTypeTask},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaramaConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		kafka   *workerstd.KafkaConfig
+		wantErr bool
+	}{
+		{name: "default version", kafka: &workerstd.KafkaConfig{Brokers: []string{"localhost:9092"}}},
+		{name: "supported version", kafka: &workerstd.KafkaConfig{Brokers: []string{"localhost:9092"}, Version: "2.8.0"}},
+		{
+			name:    "version without headers",
+			kafka:   &workerstd.KafkaConfig{Brokers: []string{"localhost:9092"}, Version: "0.10.2.0"},
+			wantErr: true,
+		},
+		{name: "no brokers", kafka: &workerstd.KafkaConfig{}, wantErr: true},
+		{name: "no config", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := saramaConfig(&workerstd.Broker{TopicName: testTopic, Kafka: tc.kafka})
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("saramaConfig error = %v, want error %t", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package workerstd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"gocloud.dev/pubsub"
+)
+
+// keepAlive starts renewing the lock on the given message in the background every LockRenewalInterval, until the
+// returned stop function is called or the MaxProcessingTime elapses. The MaxProcessingTime is counted from when the
+// returned start function is called, which is when the task handler starts, so that the lock outlives the deadline of
+// the handler even when the task waited for a slot or the rate limits first. This is a no-op for engines that don't
+// support message locks.
+func (clt *SubClient) keepAlive(
+	msg *pubsub.Message, interval, maxProcessingTime time.Duration,
+) (start func(), stop func()) {
+	var sbMsg *azservicebus.ReceivedMessage
+	if interval <= 0 || clt.receiver == nil || !msg.As(&sbMsg) {
+		return func() {}, func() {}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	startCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+
+		waitStartCh := startCh
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var deadlineCh <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-waitStartCh:
+				waitStartCh = nil
+				if maxProcessingTime > 0 {
+					deadline := time.NewTimer(maxProcessingTime)
+					defer deadline.Stop()
+					deadlineCh = deadline.C
+				}
+				continue
+			case <-deadlineCh:
+				clt.logger.Warnf("Task %s exceeded max processing time. No longer renewing lock.", msg.LoggableID)
+				return
+			case <-ticker.C:
+			}
+
+			if err := clt.receiver.RenewMessageLock(ctx, sbMsg, nil); err != nil {
+				var sbErr *azservicebus.Error
+				if errors.As(err, &sbErr) && sbErr.Code == azservicebus.CodeLockLost {
+					clt.logger.Errorf("Lost lock on message %s: %s", msg.LoggableID, err)
+					return
+				}
+				if ctx.Err() == nil {
+					clt.logger.Warnf("Error renewing lock on message %s: %s", msg.LoggableID, err)
+				}
+				continue
+			}
+			clt.logger.Debugf("Renewed lock on message %s", msg.LoggableID)
+		}
+	}()
+
+	var startOnce sync.Once
+	start = func() {
+		startOnce.Do(func() { close(startCh) })
+	}
+	stop = func() {
+		cancel()
+		<-doneCh
+	}
+	return start, stop
+}
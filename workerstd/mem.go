@@ -0,0 +1,52 @@
+package workerstd
+
+import (
+	"sync"
+	"time"
+
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/mempubsub"
+)
+
+// memAckDeadline is the duration after which unacked messages on the in-memory engine are redelivered.
+const memAckDeadline = 1 * time.Minute
+
+var (
+	memTopicsMu sync.Mutex
+	memTopics   = map[string]*memTopic{}
+)
+
+// memTopic is an in-process topic for the mem engine, along with the single subscription that all the subscriber
+// clients of the topic share. The subscription is created together with the topic so that tasks that are sent before
+// the worker starts are not lost.
+type memTopic struct {
+	topic        *pubsub.Topic
+	subscription *pubsub.Subscription
+}
+
+// getMemTopic returns the in-process topic with the given name, creating it if it does not exist yet.
+func getMemTopic(name string) *memTopic {
+	memTopicsMu.Lock()
+	defer memTopicsMu.Unlock()
+
+	t, exists := memTopics[name]
+	if !exists {
+		topic := mempubsub.NewTopic()
+		t = &memTopic{
+			topic:        topic,
+			subscription: mempubsub.NewSubscription(topic, memAckDeadline),
+		}
+		memTopics[name] = t
+	}
+	return t
+}
+
+// ResetMemTopics removes all the in-process topics of the mem engine, along with the messages that are left on them.
+// The clients that are created afterwards get new, empty topics, while the clients that are still open keep using the
+// removed topics. This is intended for test suites, so that the messages of one test are not delivered to the next test
+// that uses the same topic name.
+func ResetMemTopics() {
+	memTopicsMu.Lock()
+	defer memTopicsMu.Unlock()
+	memTopics = map[string]*memTopic{}
+}
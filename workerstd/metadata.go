@@ -0,0 +1,43 @@
+package workerstd
+
+// Keys and values of the pubsub message metadata that are set by the PubClient and interpreted by the SubClient and
+// worker.
+const (
+	// MetadataKeyType is the metadata key that describes what kind of message is being sent.
+	MetadataKeyType = "type"
+
+	// MetadataTypeTask is the MetadataKeyType value for messages that represent a worker task.
+	MetadataTypeTask = "Task"
+
+	// MetadataKeyTaskName is the metadata key that records the protobuf full name of the task message. This is used by
+	// the TaskRegistry to dispatch the task to the right handler.
+	MetadataKeyTaskName = "task_name"
+
+	// MetadataKeyContentType is the metadata key that records the content type of the Codec that was used to encode the
+	// message body.
+	MetadataKeyContentType = "content-type"
+
+	// MetadataKeyMessageID is the metadata key that records the unique ID of the task message. This is stamped by the
+	// PubClient on send (or set with WithMessageID), is preserved across retries, and is used by the IdempotencyStore to
+	// detect redeliveries of a task that already completed.
+	MetadataKeyMessageID = "message_id"
+
+	// MetadataKeyAttempt is the metadata key that records which attempt (starting from 1) of the task the message
+	// represents. This is incremented each time the task is retried by the worker.
+	MetadataKeyAttempt = "attempt"
+
+	// MetadataKeyDeliveryCount is the metadata key that records how many times (starting from 1) the broker delivered the
+	// message. This is set on the received messages by the engines that track redeliveries, but don't expose them
+	// through the driver message (e.g., NATS JetStream), so that the redeliveries count towards the attempts of the task.
+	MetadataKeyDeliveryCount = "delivery_count"
+
+	// MetadataKeyDeadLetterError is the metadata key that records the error that caused the task to be dead-lettered.
+	MetadataKeyDeadLetterError = "deadletter_error"
+
+	// MetadataKeyDeadLetterTopic is the metadata key that records the topic that the task was originally published on
+	// before it was dead-lettered.
+	MetadataKeyDeadLetterTopic = "deadletter_original_topic"
+
+	// MetadataKeyDeadLetterTime is the metadata key that records when the task was dead-lettered, in RFC3339 format.
+	MetadataKeyDeadLetterTime = "deadletter_timestamp"
+)
@@ -0,0 +1,10 @@
+// Package natsengine registers the nats engine for workerstd, which stores the tasks in NATS JetStream. Import this
+// package for its side effects to enable the engine:
+//
+//	import _ "github.com/illumitacit/gostd/workerstd/natsengine"
+//
+// The engine is configured with the NATS field of the workerstd.Broker. The tasks are published to the TopicName
+// subject of a JetStream stream, and the workers share a durable pull consumer on the stream. Failed tasks are nacked
+// so that JetStream redelivers them once the backoff of the RetryPolicy of the broker has elapsed, and the redeliveries
+// count towards the attempts of the RetryPolicy.
+package natsengine
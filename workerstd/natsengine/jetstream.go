@@ -0,0 +1,240 @@
+package natsengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub/batcher"
+	"gocloud.dev/pubsub/driver"
+
+	"github.com/illumitacit/gostd/workerstd"
+)
+
+// jetStreamFetchTimeout is how long a receive waits for JetStream to deliver messages before returning an empty batch,
+// so that the subscription can check whether it is being shut down.
+const jetStreamFetchTimeout = 1 * time.Second
+
+// jetStreamRecvBatcherOpts only fetch one message at a time, so that the messages don't sit in the subscription (and
+// use up their AckWait) while the worker is busy processing other tasks.
+var jetStreamRecvBatcherOpts = &batcher.Options{
+	MaxBatchSize: 1,
+	MaxHandlers:  1,
+}
+
+// jetStreamTopic is the gocloud pubsub driver for publishing messages to a JetStream subject. The message metadata is
+// sent in the NATS headers.
+type jetStreamTopic struct {
+	js      nats.JetStreamContext
+	subject string
+}
+
+var _ driver.Topic = (*jetStreamTopic)(nil)
+
+// SendBatch implements driver.Topic. This waits for JetStream to acknowledge that each message was stored.
+func (t *jetStreamTopic) SendBatch(ctx context.Context, msgs []*driver.Message) error {
+	for _, m := range msgs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		natsMsg := nats.NewMsg(t.subject)
+		natsMsg.Data = m.Body
+		for k, v := range m.Metadata {
+			// NOTE: set the header directly instead of with Header.Set, so that the metadata keys are kept as is.
+			natsMsg.Header[k] = []string{v}
+		}
+		if m.BeforeSend != nil {
+			if err := m.BeforeSend(natsMsgAsFunc(natsMsg)); err != nil {
+				return err
+			}
+		}
+		if _, err := t.js.PublishMsg(natsMsg, nats.Context(ctx)); err != nil {
+			return err
+		}
+		if m.AfterSend != nil {
+			if err := m.AfterSend(natsMsgAsFunc(natsMsg)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// IsRetryable implements driver.Topic.
+func (*jetStreamTopic) IsRetryable(error) bool { return false }
+
+// As implements driver.Topic. This supports nats.JetStreamContext.
+func (t *jetStreamTopic) As(i interface{}) bool {
+	p, ok := i.(*nats.JetStreamContext)
+	if !ok {
+		return false
+	}
+	*p = t.js
+	return true
+}
+
+// ErrorAs implements driver.Topic.
+func (*jetStreamTopic) ErrorAs(err error, i interface{}) bool {
+	return errors.As(err, i)
+}
+
+// ErrorCode implements driver.Topic.
+func (*jetStreamTopic) ErrorCode(err error) gcerrors.ErrorCode {
+	return jetStreamErrorCode(err)
+}
+
+// Close implements driver.Topic.
+func (*jetStreamTopic) Close() error { return nil }
+
+// jetStreamSubscription is the gocloud pubsub driver for receiving messages from a pull subscription on a JetStream
+// consumer.
+type jetStreamSubscription struct {
+	sub *nats.Subscription
+}
+
+var _ driver.Subscription = (*jetStreamSubscription)(nil)
+
+// ReceiveBatch implements driver.Subscription. This returns an empty batch when no message is delivered within the
+// jetStreamFetchTimeout.
+func (s *jetStreamSubscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*driver.Message, error) {
+	fetchCtx, cancel := context.WithTimeout(ctx, jetStreamFetchTimeout)
+	defer cancel()
+	natsMsgs, err := s.sub.Fetch(maxMessages, nats.Context(fetchCtx))
+	if err != nil {
+		if ctx.Err() == nil && (errors.Is(err, context.DeadlineExceeded) || errors.Is(err, nats.ErrTimeout)) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	msgs := make([]*driver.Message, 0, len(natsMsgs))
+	for _, natsMsg := range natsMsgs {
+		msg, err := decodeJetStreamMsg(natsMsg)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// decodeJetStreamMsg converts a message received from JetStream into a driver message. The number of times that
+// JetStream delivered the message is added to the metadata, so that the redeliveries count towards the attempts of
+// the task.
+func decodeJetStreamMsg(natsMsg *nats.Msg) (*driver.Message, error) {
+	meta, err := natsMsg.Metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]string{}
+	for k, v := range natsMsg.Header {
+		if len(v) > 0 {
+			metadata[k] = v[0]
+		}
+	}
+	metadata[workerstd.MetadataKeyDeliveryCount] = strconv.FormatUint(meta.NumDelivered, 10)
+
+	return &driver.Message{
+		LoggableID: fmt.Sprintf("%s#%d", meta.Stream, meta.Sequence.Stream),
+		Body:       natsMsg.Data,
+		Metadata:   metadata,
+		AckID:      natsMsg,
+		AsFunc:     natsMsgAsFunc(natsMsg),
+	}, nil
+}
+
+// SendAcks implements driver.Subscription.
+func (*jetStreamSubscription) SendAcks(_ context.Context, ids []driver.AckID) error {
+	for _, id := range ids {
+		if err := id.(*nats.Msg).Ack(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CanNack implements driver.Subscription.
+func (*jetStreamSubscription) CanNack() bool { return true }
+
+// SendNacks implements driver.Subscription. JetStream redelivers the nacked messages right away. The messages that were
+// already nacked with Engine.NackWithDelay are skipped.
+func (*jetStreamSubscription) SendNacks(_ context.Context, ids []driver.AckID) error {
+	for _, id := range ids {
+		if err := id.(*nats.Msg).Nak(); err != nil && !errors.Is(err, nats.ErrMsgAlreadyAckd) {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsRetryable implements driver.Subscription.
+func (*jetStreamSubscription) IsRetryable(error) bool { return false }
+
+// As implements driver.Subscription. This supports *nats.Subscription.
+func (s *jetStreamSubscription) As(i interface{}) bool {
+	p, ok := i.(**nats.Subscription)
+	if !ok {
+		return false
+	}
+	*p = s.sub
+	return true
+}
+
+// ErrorAs implements driver.Subscription.
+func (*jetStreamSubscription) ErrorAs(err error, i interface{}) bool {
+	return errors.As(err, i)
+}
+
+// ErrorCode implements driver.Subscription.
+func (*jetStreamSubscription) ErrorCode(err error) gcerrors.ErrorCode {
+	return jetStreamErrorCode(err)
+}
+
+// Close implements driver.Subscription. This does not delete the durable consumer, so that the tasks that are
+// published while no worker is running are retained.
+func (s *jetStreamSubscription) Close() error {
+	if err := s.sub.Unsubscribe(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+		return err
+	}
+	return nil
+}
+
+// natsMsgAsFunc returns the As function of a driver message, which supports *nats.Msg.
+func natsMsgAsFunc(natsMsg *nats.Msg) func(interface{}) bool {
+	return func(i interface{}) bool {
+		p, ok := i.(**nats.Msg)
+		if !ok {
+			return false
+		}
+		*p = natsMsg
+		return true
+	}
+}
+
+// jetStreamErrorCode maps the errors returned by the NATS client to the gocloud error codes.
+func jetStreamErrorCode(err error) gcerrors.ErrorCode {
+	switch {
+	case err == nil:
+		return gcerrors.OK
+	case errors.Is(err, context.Canceled):
+		return gcerrors.Canceled
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, nats.ErrTimeout):
+		return gcerrors.DeadlineExceeded
+	case errors.Is(err, nats.ErrStreamNotFound), errors.Is(err, nats.ErrConsumerNotFound),
+		errors.Is(err, nats.ErrNoStreamResponse):
+		return gcerrors.NotFound
+	case errors.Is(err, nats.ErrAuthorization):
+		return gcerrors.PermissionDenied
+	case errors.Is(err, nats.ErrMaxPayload), errors.Is(err, nats.ErrReconnectBufExceeded):
+		return gcerrors.ResourceExhausted
+	case errors.Is(err, nats.ErrConnectionClosed), errors.Is(err, nats.ErrBadSubscription):
+		return gcerrors.FailedPrecondition
+	}
+	return gcerrors.Unknown
+}
@@ -0,0 +1,205 @@
+package natsengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+	"gocloud.dev/pubsub"
+
+	"github.com/illumitacit/gostd/workerstd"
+)
+
+// EngineName is the name of the engine in the Engine field of the workerstd.Broker.
+const EngineName = "nats"
+
+func init() {
+	workerstd.RegisterEngine(EngineName, Engine{})
+}
+
+// Engine is the workerstd.Engine for NATS.
+type Engine struct{}
+
+var _ workerstd.DelayedNackEngine = Engine{}
+
+// OpenTopic implements workerstd.Engine.
+func (Engine) OpenTopic(
+	_ context.Context, logger *zap.SugaredLogger, broker *workerstd.Broker,
+) (*pubsub.Topic, func() error, error) {
+	nc, js, err := connect(logger, broker)
+	if err != nil {
+		return nil, nil, err
+	}
+	if broker.NATS.DeclareStream {
+		if _, err := stream(js, broker); err != nil {
+			nc.Close()
+			return nil, nil, err
+		}
+	}
+	batcherOpts := broker.PublishBatching.BatcherOptions()
+	topic := pubsub.NewTopic(&jetStreamTopic{js: js, subject: broker.TopicName}, &batcherOpts)
+	return topic, closeFn(nc), nil
+}
+
+// OpenSubscription implements workerstd.Engine.
+func (Engine) OpenSubscription(
+	_ context.Context, logger *zap.SugaredLogger, broker *workerstd.Broker,
+) (*pubsub.Subscription, func() error, error) {
+	nc, js, err := connect(logger, broker)
+	if err != nil {
+		return nil, nil, err
+	}
+	sub, err := pullSubscribe(js, broker)
+	if err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+	subscription := pubsub.NewSubscription(&jetStreamSubscription{sub: sub}, jetStreamRecvBatcherOpts, nil)
+	return subscription, closeFn(nc), nil
+}
+
+// NackWithDelay implements workerstd.DelayedNackEngine.
+func (Engine) NackWithDelay(msg *pubsub.Message, delay time.Duration) error {
+	var natsMsg *nats.Msg
+	if !msg.As(&natsMsg) {
+		return fmt.Errorf("Message %s was not received from NATS", msg.LoggableID)
+	}
+	return natsMsg.NakWithDelay(delay)
+}
+
+// stream returns the name of the JetStream stream that stores the tasks of the broker. When the stream does not exist
+// and the broker is configured to declare it, the stream is created.
+func stream(js nats.JetStreamContext, broker *workerstd.Broker) (string, error) {
+	name := broker.NATS.Stream
+	if name == "" {
+		found, err := js.StreamNameBySubject(broker.TopicName)
+		if err == nil {
+			return found, nil
+		}
+		if !errors.Is(err, nats.ErrNoMatchingStream) {
+			return "", err
+		}
+		if !broker.NATS.DeclareStream {
+			return "", fmt.Errorf("No JetStream stream stores the subject %s", broker.TopicName)
+		}
+		name = natsName(broker.TopicName)
+	} else {
+		_, err := js.StreamInfo(name)
+		if err == nil {
+			return name, nil
+		}
+		if !errors.Is(err, nats.ErrStreamNotFound) {
+			return "", err
+		}
+		if !broker.NATS.DeclareStream {
+			return "", fmt.Errorf("JetStream stream %s does not exist", name)
+		}
+	}
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:      name,
+		Subjects:  []string{broker.TopicName},
+		Retention: nats.WorkQueuePolicy,
+		Storage:   nats.FileStorage,
+	})
+	// NOTE: another client may have created the stream since it was looked up, which is fine as long as it is the same
+	// stream.
+	if err != nil && !errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+		return "", fmt.Errorf("Error creating JetStream stream %s: %w", name, err)
+	}
+	return name, nil
+}
+
+// pullSubscribe binds a pull subscription to the durable consumer of the broker, creating the consumer if it does not
+// exist yet.
+func pullSubscribe(js nats.JetStreamContext, broker *workerstd.Broker) (*nats.Subscription, error) {
+	streamName, err := stream(js, broker)
+	if err != nil {
+		return nil, err
+	}
+	consumer := broker.NATS.Consumer
+	if consumer == "" {
+		consumer = natsName(broker.TopicName)
+	}
+
+	if _, err := js.ConsumerInfo(streamName, consumer); err != nil {
+		if !errors.Is(err, nats.ErrConsumerNotFound) {
+			return nil, err
+		}
+		ackWait := broker.NATS.AckWait
+		if ackWait <= 0 {
+			ackWait = broker.MaxProcessingTime
+		}
+		_, err := js.AddConsumer(streamName, &nats.ConsumerConfig{
+			Durable:       consumer,
+			DeliverPolicy: nats.DeliverAllPolicy,
+			AckPolicy:     nats.AckExplicitPolicy,
+			AckWait:       ackWait,
+			FilterSubject: broker.TopicName,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error creating JetStream consumer %s on stream %s: %w", consumer, streamName, err)
+		}
+	}
+
+	// NOTE: bind to the consumer instead of letting the client create it, as the client deletes the consumers it creates
+	// when unsubscribing.
+	return js.PullSubscribe(broker.TopicName, "", nats.Bind(streamName, consumer))
+}
+
+// natsName returns the given subject with the characters that are not allowed in stream and consumer names replaced
+// with underscores.
+func natsName(subject string) string {
+	return natsNameReplacer.Replace(subject)
+}
+
+var natsNameReplacer = strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_", "/", "_", "\\", "_")
+
+// connect opens a connection to the NATS servers configured on the broker, and returns it along with its JetStream
+// context.
+func connect(logger *zap.SugaredLogger, broker *workerstd.Broker) (*nats.Conn, nats.JetStreamContext, error) {
+	if broker.NATS == nil || broker.NATS.URL == "" {
+		return nil, nil, fmt.Errorf("NATS URL is required for the %s engine", EngineName)
+	}
+
+	opts := []nats.Option{
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				logger.Errorf("Lost connection to NATS: %s", err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			logger.Infof("Reconnected to NATS at %s", nc.ConnectedUrl())
+		}),
+		// NOTE: keep reconnecting for as long as the process runs, like the RabbitMQ connection.
+		nats.MaxReconnects(-1),
+	}
+	if broker.NATS.CredentialsFile != "" {
+		opts = append(opts, nats.UserCredentials(broker.NATS.CredentialsFile))
+	}
+	nc, err := nats.Connect(broker.NATS.URL, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+	return nc, js, nil
+}
+
+// closeFn returns the function that flushes the pending messages and closes the given NATS connection.
+func closeFn(nc *nats.Conn) func() error {
+	return func() error {
+		defer nc.Close()
+		if err := nc.Flush(); err != nil && err != nats.ErrConnectionClosed {
+			return err
+		}
+		return nil
+	}
+}
@@ -0,0 +1,193 @@
+package natsengine
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/illumitacit/gostd/quit"
+	"github.com/illumitacit/gostd/workerstd"
+	"github.com/illumitacit/gostd/workerstd/internal/workertest"
+)
+
+// newTestBroker starts an embedded NATS server with JetStream enabled, and returns a broker config for the given topic
+// on that server, which declares the stream.
+func newTestBroker(t *testing.T, topic string) *workerstd.Broker {
+	t.Helper()
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	t.Cleanup(srv.Shutdown)
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("Timed out waiting for the NATS server to start")
+	}
+
+	return &workerstd.Broker{
+		Engine:    EngineName,
+		TopicName: topic,
+		NATS: &workerstd.NATSConfig{
+			URL:           srv.ClientURL(),
+			DeclareStream: true,
+		},
+	}
+}
+
+func TestPublishBeforeSubscribe(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	broker := newTestBroker(t, "tasks.durable")
+
+	pubClt, err := workerstd.NewPubClient(logger, broker, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pubClt.Close()
+	if err := pubClt.SendTaskCtx(context.Background(), wrapperspb.String("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	subClt, err := workerstd.NewSubClient(logger, broker, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subClt.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	task := &wrapperspb.StringValue{}
+	msg, err := subClt.ReceiveTask(ctx, task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Ack()
+	if got := task.GetValue(); got != "hello" {
+		t.Errorf("Received task %q, want %q", got, "hello")
+	}
+}
+
+func TestNackRedelivers(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	broker := newTestBroker(t, "tasks.nack")
+
+	pubClt, err := workerstd.NewPubClient(logger, broker, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pubClt.Close()
+	subClt, err := workerstd.NewSubClient(logger, broker, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subClt.Close()
+
+	if err := pubClt.SendTaskCtx(context.Background(), wrapperspb.String("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, wantDeliveryCount := range []string{"1", "2"} {
+		task := &wrapperspb.StringValue{}
+		msg, err := subClt.ReceiveTask(ctx, task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := task.GetValue(); got != "hello" {
+			t.Errorf("Received task %q, want %q", got, "hello")
+		}
+		if got := msg.Metadata[workerstd.MetadataKeyDeliveryCount]; got != wantDeliveryCount {
+			t.Errorf("Received task with delivery count %q, want %q", got, wantDeliveryCount)
+		}
+		if wantDeliveryCount == "1" {
+			msg.Nack()
+		} else {
+			msg.Ack()
+		}
+	}
+}
+
+func TestRunEndToEnd(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	broker := newTestBroker(t, "tasks.run")
+	backoff := 500 * time.Millisecond
+	broker.RetryPolicy = &workerstd.RetryPolicy{MaxAttempts: 3, InitialBackoff: backoff}
+
+	pubClt, err := workerstd.NewPubClient(logger, broker, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pubClt.Close()
+	for _, value := range []string{"a", "b", "c"} {
+		if err := pubClt.SendTaskCtx(context.Background(), wrapperspb.String(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The task "b" fails on its first attempt, to exercise the redelivery of the nacked tasks after the backoff.
+	var attemptsMu sync.Mutex
+	attempts := map[string]int{}
+	var failedAt, retriedAt time.Time
+	receivedCh := make(chan string, 10)
+	registry := workerstd.NewTaskRegistry()
+	workerstd.RegisterTask(registry, func(ctx context.Context, task *wrapperspb.StringValue) error {
+		value := task.GetValue()
+		attemptsMu.Lock()
+		attempts[value]++
+		attempt := attempts[value]
+		if value == "b" && attempt == 1 {
+			failedAt = time.Now()
+		} else if value == "b" {
+			retriedAt = time.Now()
+		}
+		attemptsMu.Unlock()
+		if value == "b" && attempt == 1 {
+			return errors.New("transient error")
+		}
+		receivedCh <- value
+		return nil
+	})
+	app := &workerstd.App{
+		Broker:          broker,
+		Logger:          logger,
+		ShutdownTimeout: 10 * time.Second,
+		Registry:        registry,
+		AutoAck:         true,
+		Concurrency:     2,
+		Lifecycle:       quit.New(),
+	}
+	stop := workertest.Run(t, app.Run)
+
+	received := workertest.CollectSorted(t, receivedCh, 3, 10*time.Second)
+	if got, want := received, []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Received tasks %v, want %v", got, want)
+	}
+	attemptsMu.Lock()
+	if delay := retriedAt.Sub(failedAt); delay < backoff {
+		t.Errorf("Task was redelivered after %s, want at least the backoff of %s", delay, backoff)
+	}
+	attemptsMu.Unlock()
+	if err := stop(); err != nil {
+		t.Errorf("Run returned error: %s", err)
+	}
+}
+
+func TestNATSName(t *testing.T) {
+	if got, want := natsName("tasks.emails.*"), "tasks_emails__"; got != want {
+		t.Errorf("natsName = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,86 @@
+package workerstd
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// waitInterval is how often taskPool.acquire calls the wait function while waiting for a slot.
+const waitInterval = 1 * time.Second
+
+// taskPool is a bounded goroutine pool for running task handlers. Slots are acquired before a message is received from
+// the broker so that the worker applies backpressure: when all slots are in use, no new messages are pulled from the
+// subscription until one of the in-flight tasks completes.
+type taskPool struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+// newTaskPool returns a task pool that runs at most size tasks concurrently. A size less than 1 is treated as 1, which
+// matches the behavior of processing tasks one at a time.
+func newTaskPool(size int) *taskPool {
+	if size < 1 {
+		size = 1
+	}
+	return &taskPool{
+		slots: make(chan struct{}, size),
+	}
+}
+
+// acquire blocks until a slot is available in the pool. This returns false if the done channel is closed before a slot
+// is available, in which case no slot is held. While waiting, the wait function is called every waitInterval, which is
+// used to report that the worker is still alive while all the slots are held by long running tasks.
+func (p *taskPool) acquire(done <-chan struct{}, wait func()) bool {
+	// Prefer the done channel if it is already closed so that we don't pick up new work during shutdown.
+	select {
+	case <-done:
+		return false
+	default:
+	}
+
+	ticker := time.NewTicker(waitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case p.slots <- struct{}{}:
+			return true
+		case <-done:
+			return false
+		case <-ticker.C:
+			wait()
+		}
+	}
+}
+
+// release frees up a slot that was acquired but not used to run a task.
+func (p *taskPool) release() {
+	<-p.slots
+}
+
+// run executes the given function in the background on a previously acquired slot, releasing the slot when the
+// function returns.
+func (p *taskPool) run(fn func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer p.release()
+		fn()
+	}()
+}
+
+// wait blocks until all in-flight tasks have completed, or until the given context is done.
+func (p *taskPool) wait(ctx context.Context) error {
+	doneCh := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
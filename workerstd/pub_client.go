@@ -3,10 +3,15 @@ package workerstd
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/google/uuid"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"gocloud.dev/pubsub"
 	"gocloud.dev/pubsub/azuresb"
@@ -15,75 +20,323 @@ import (
 )
 
 type PubClient struct {
-	topic *pubsub.Topic
+	topicMu   sync.RWMutex
+	topic     *pubsub.Topic
+	topicName string
+	engine    string
+	codec     Codec
+	tracing   tracing
 
-	ctx        context.Context
-	logger     *zap.SugaredLogger
-	sender     *azservicebus.Sender
-	rabbitConn *amqp.Connection
+	ctx    context.Context
+	logger *zap.SugaredLogger
+	sender *azservicebus.Sender
+	rabbit *rabbitConnection
+
+	// closeEngine releases the connections of a registered engine. Only set when using an engine that was registered
+	// with RegisterEngine.
+	closeEngine func() error
+
+	// shared is true when the topic is shared with other clients in the process (as is the case with the mem engine),
+	// in which case the topic is not shut down on Close.
+	shared bool
 }
 
 // NewPubClient returns an initialized publisher client for the configured broker from the given application config.
 func NewPubClient(logger *zap.SugaredLogger, broker *Broker, ctx context.Context) (*PubClient, error) {
+	var clt *PubClient
+	var err error
 	switch broker.Engine {
 	case "azuresb":
-		return newAzureSBSenderClient(logger, broker, ctx)
+		clt, err = newAzureSBSenderClient(logger, broker, ctx)
 	case "rabbitmq":
-		return newRabbitMQPublisherClient(logger, broker, ctx)
+		clt, err = newRabbitMQPublisherClient(logger, broker, ctx)
+	case "mem":
+		clt, err = newMemPublisherClient(logger, broker, ctx)
+	default:
+		clt, err = newEnginePublisherClient(logger, broker, ctx)
+	}
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("Unknown engine")
+	clt.topicName = broker.TopicName
+	clt.engine = broker.Engine
+	return clt, nil
 }
 
-// Close will close all the associated connections of the given publisher client.
+// Close will close all the associated connections of the given publisher client, using the context that was passed to
+// NewPubClient.
 func (clt *PubClient) Close() error {
 	if clt == nil {
 		return nil
 	}
+	return clt.CloseCtx(clt.ctx)
+}
 
-	if err := clt.topic.Shutdown(clt.ctx); err != nil {
-		clt.logger.Errorf("Error shutting down publisher: %s", err)
-		return err
+// CloseCtx will close all the associated connections of the given publisher client, using the given context to bound
+// the shutdown.
+func (clt *PubClient) CloseCtx(ctx context.Context) error {
+	if clt == nil {
+		return nil
+	}
+
+	// NOTE: there is no need to shutdown the topic if the RabbitMQ connection is lost, as the topic is unusable.
+	if !clt.shared && (clt.rabbit == nil || clt.rabbit.isConnected()) {
+		clt.topicMu.RLock()
+		topic := clt.topic
+		clt.topicMu.RUnlock()
+		if err := topic.Shutdown(ctx); err != nil {
+			clt.logger.Errorf("Error shutting down publisher: %s", err)
+			return err
+		}
 	}
 
 	if clt.sender != nil {
-		if err := clt.sender.Close(clt.ctx); err != nil {
+		if err := clt.sender.Close(ctx); err != nil {
 			clt.logger.Errorf("Error closing Azure PubSub sender: %s", err)
 			return err
 		}
 	}
 
-	if clt.rabbitConn != nil {
-		if err := clt.rabbitConn.Close(); err != nil {
+	if clt.rabbit != nil {
+		if err := clt.rabbit.Close(); err != nil {
 			clt.logger.Errorf("Error closing RabbitMQ connection: %s", err)
 			return err
 		}
 	}
 
+	if clt.closeEngine != nil {
+		if err := clt.closeEngine(); err != nil {
+			clt.logger.Errorf("Error closing broker connection: %s", err)
+			return err
+		}
+	}
+
 	return nil
 }
 
-// SendTask will send a protobuf encoded message representing a worker task across the open pubsub topic.
+// SetCodec sets the codec that is used to encode the tasks sent by the client. Defaults to ProtobufCodec.
+func (clt *PubClient) SetCodec(codec Codec) {
+	clt.codec = codec
+}
+
+// SetTracerProvider sets the OpenTelemetry TracerProvider that is used to create the publish spans. Defaults to the
+// global TracerProvider, which is a no-op unless configured with otel.SetTracerProvider.
+func (clt *PubClient) SetTracerProvider(tp trace.TracerProvider) {
+	clt.tracing.tracerProvider = tp
+}
+
+// SetPropagator sets the OpenTelemetry propagator that is used to inject the trace context into the message metadata.
+// Defaults to the W3C trace context propagator (traceparent and tracestate), which must match the propagator of the
+// worker App.
+func (clt *PubClient) SetPropagator(propagator propagation.TextMapPropagator) {
+	clt.tracing.propagator = propagator
+}
+
+// SendTask will send an encoded message representing a worker task across the open pubsub topic, using the context
+// that was passed to NewPubClient. The task is encoded with the codec of the client, which is recorded in the message
+// metadata.
 func (clt *PubClient) SendTask(task proto.Message) error {
-	taskMsg, err := proto.Marshal(task)
+	return clt.SendTaskCtx(clt.ctx, task)
+}
+
+// SendTaskCtx will send an encoded message representing a worker task across the open pubsub topic, using the given
+// context to bound the send. The options can be used to customize the message, such as setting custom metadata. The
+// trace context of the given context is propagated in the message metadata, so that the worker span is linked to the
+// trace of the sender (e.g., the HTTP request that published the task).
+func (clt *PubClient) SendTaskCtx(ctx context.Context, task proto.Message, opts ...SendOption) error {
+	sendOpts := newSendOptions(opts)
+	msg, err := clt.newTaskMsg(task, sendOpts)
 	if err != nil {
 		return err
 	}
-	return clt.topic.Send(clt.ctx, &pubsub.Message{
+	return clt.sendTaskMsg(ctx, msg, sendOpts)
+}
+
+// ScheduleTask will send an encoded message representing a worker task across the open pubsub topic, to be delivered
+// to the subscribers at the given time instead of immediately. Tasks that are scheduled in the past are delivered
+// immediately.
+//
+// Azure ServiceBus schedules the message natively. For RabbitMQ, the message is held in a delay queue until it is due,
+// see WithDeliveryTime for the caveats.
+func (clt *PubClient) ScheduleTask(ctx context.Context, task proto.Message, at time.Time) error {
+	return clt.SendTaskCtx(ctx, task, WithDeliveryTime(at))
+}
+
+// SendTasks will send the given tasks across the open pubsub topic concurrently, so that they can be batched by the
+// publisher according to the PublishBatching config of the broker. This blocks until all the tasks have been sent. The
+// returned error combines the errors of all the tasks that failed to send.
+//
+// Note that for RabbitMQ, the publisher waits for the broker to confirm each message, so a nil error means that the
+// broker has accepted all the tasks.
+//
+// The options apply to all the tasks, so WithMessageID is rejected as it would give all the tasks the same ID, causing
+// all but one of them to be dropped as duplicates. Use SendTaskAsync to send a batch of tasks with their own IDs.
+func (clt *PubClient) SendTasks(ctx context.Context, tasks []proto.Message, opts ...SendOption) error {
+	sendOpts := newSendOptions(opts)
+	if sendOpts.messageID != "" {
+		return fmt.Errorf("WithMessageID can not be used with SendTasks, as the ID would be shared by all the tasks")
+	}
+	msgs := make([]*pubsub.Message, len(tasks))
+	for i, task := range tasks {
+		msg, err := clt.newTaskMsg(task, sendOpts)
+		if err != nil {
+			return fmt.Errorf("Error encoding task %d: %w", i, err)
+		}
+		msgs[i] = msg
+	}
+
+	errs := make([]error, len(msgs))
+	var wg sync.WaitGroup
+	for i, msg := range msgs {
+		i, msg := i, msg
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := clt.sendTaskMsg(ctx, msg, sendOpts); err != nil {
+				errs[i] = fmt.Errorf("Error sending task %d: %w", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return multierr.Combine(errs...)
+}
+
+// SendTaskAsync will send the given task across the open pubsub topic in the background. The returned channel receives
+// the result of the send once the broker has accepted the task (or the send fails), and is then closed.
+func (clt *PubClient) SendTaskAsync(ctx context.Context, task proto.Message, opts ...SendOption) <-chan error {
+	resultCh := make(chan error, 1)
+	sendOpts := newSendOptions(opts)
+	msg, err := clt.newTaskMsg(task, sendOpts)
+	if err != nil {
+		resultCh <- err
+		close(resultCh)
+		return resultCh
+	}
+
+	go func() {
+		defer close(resultCh)
+		resultCh <- clt.sendTaskMsg(ctx, msg, sendOpts)
+	}()
+	return resultCh
+}
+
+// newTaskMsg encodes the given task with the codec of the client into a pubsub message, with the metadata describing
+// the task and the given send options applied.
+func (clt *PubClient) newTaskMsg(task proto.Message, sendOpts *sendOptions) (*pubsub.Message, error) {
+	codec := clt.codec
+	if codec == nil {
+		codec = ProtobufCodec
+	}
+
+	taskMsg, err := codec.Marshal(task)
+	if err != nil {
+		return nil, err
+	}
+	messageID := sendOpts.messageID
+	if messageID == "" {
+		messageID = uuid.NewString()
+	}
+	msg := &pubsub.Message{
 		Body: taskMsg,
 		Metadata: map[string]string{
-			// TODO: use enum
-			"type": "Task",
+			MetadataKeyType:        MetadataTypeTask,
+			MetadataKeyTaskName:    string(taskName(task)),
+			MetadataKeyContentType: codec.ContentType(),
+			MetadataKeyMessageID:   messageID,
+			MetadataKeyAttempt:     "1",
 		},
+	}
+	sendOpts.apply(msg)
+	return msg, nil
+}
+
+// sendTaskMsg sends a task message created by newTaskMsg across the open pubsub topic. Scheduled messages are routed
+// through the delay queue for RabbitMQ, and through a timer for the mem engine, as gocloud has no portable way to
+// schedule a message. Scheduled delivery is not supported with the engines registered with RegisterEngine.
+func (clt *PubClient) sendTaskMsg(
+	ctx context.Context, msg *pubsub.Message, sendOpts *sendOptions,
+) (returnErr error) {
+	ctx, span := clt.tracing.startPublishSpan(ctx, clt.engine, clt.topicName, msg)
+	defer func() {
+		endSpan(span, returnErr)
+	}()
+	return clt.sendScheduledMsg(ctx, msg, sendOpts)
+}
+
+// sendScheduledMsg sends a message with the given send options applied across the open pubsub topic, routing it
+// according to the delivery time of the options. See sendTaskMsg.
+func (clt *PubClient) sendScheduledMsg(ctx context.Context, msg *pubsub.Message, sendOpts *sendOptions) error {
+	if sendOpts.deliveryTime.IsZero() || clt.sender != nil {
+		return clt.sendMsg(ctx, msg)
+	}
+
+	if clt.rabbit != nil {
+		publishing := rabbitMQPublishing(msg, sendOpts.messageID)
+		return clt.rabbit.publishDelayed(ctx, clt.topicName, publishing, sendOpts.deliveryTime)
+	}
+	if !clt.shared {
+		return fmt.Errorf("Scheduled delivery is not supported with the %s engine", clt.engine)
+	}
+
+	time.AfterFunc(time.Until(sendOpts.deliveryTime), func() {
+		if err := clt.sendMsg(context.Background(), msg); err != nil {
+			clt.logger.Errorf("Error sending scheduled task: %s", err)
+		}
 	})
+	return nil
 }
 
-func newAzureSBSenderClient(
-	logger *zap.SugaredLogger, broker *Broker, ctx context.Context) (*PubClient, error) {
-	cred, err := azidentity.NewDefaultAzureCredential(nil)
+// sendMsg sends a raw pubsub message across the open pubsub topic. This returns an error wrapping ErrBrokerUnavailable
+// if the connection to the broker is lost.
+func (clt *PubClient) sendMsg(ctx context.Context, msg *pubsub.Message) error {
+	topic, err := clt.getTopic()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if err := topic.Send(ctx, msg); err != nil {
+		if clt.rabbit != nil && ctx.Err() == nil && isRabbitMQConnErr(err, topic.ErrorAs) {
+			return fmt.Errorf("%w: %s", ErrBrokerUnavailable, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// getTopic returns the current pubsub topic of the client. This returns an error wrapping ErrBrokerUnavailable while
+// reconnecting to the broker.
+func (clt *PubClient) getTopic() (*pubsub.Topic, error) {
+	if clt.rabbit != nil && !clt.rabbit.isConnected() {
+		return nil, fmt.Errorf("%w: reconnecting to RabbitMQ", ErrBrokerUnavailable)
 	}
-	clt, err := azservicebus.NewClient(broker.ConnectionString, cred, nil)
+
+	clt.topicMu.RLock()
+	defer clt.topicMu.RUnlock()
+	return clt.topic, nil
+}
+
+// setTopic replaces the pubsub topic of the client, shutting down the previous topic in the background. This is used
+// when the topic is reopened after reconnecting to the broker.
+func (clt *PubClient) setTopic(topic *pubsub.Topic) {
+	clt.topicMu.Lock()
+	oldTopic := clt.topic
+	clt.topic = topic
+	clt.topicMu.Unlock()
+
+	if oldTopic != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := oldTopic.Shutdown(ctx); err != nil {
+				clt.logger.Debugf("Error shutting down stale publisher: %s", err)
+			}
+		}()
+	}
+}
+
+func newAzureSBSenderClient(
+	logger *zap.SugaredLogger, broker *Broker, ctx context.Context) (*PubClient, error) {
+	clt, err := newAzureSBClient(broker)
 	if err != nil {
 		return nil, err
 	}
@@ -91,7 +344,9 @@ func newAzureSBSenderClient(
 	if err != nil {
 		return nil, err
 	}
-	topic, err := azuresb.OpenTopic(ctx, sender, nil)
+	topic, err := azuresb.OpenTopic(ctx, sender, &azuresb.TopicOptions{
+		BatcherOptions: broker.PublishBatching.BatcherOptions(),
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -106,16 +361,28 @@ func newAzureSBSenderClient(
 func newRabbitMQPublisherClient(
 	logger *zap.SugaredLogger, broker *Broker, ctx context.Context,
 ) (*PubClient, error) {
-	rabbitConn, err := amqp.Dial(fmt.Sprintf("amqp://%s/", broker.ConnectionString))
+	clt := &PubClient{
+		topicName: broker.TopicName,
+		logger:    logger,
+		ctx:       ctx,
+	}
+	rabbit, err := dialRabbitMQ(logger, broker, func(conn *amqp.Connection) {
+		clt.setTopic(rabbitpubsub.OpenTopic(conn, broker.TopicName, nil))
+	})
 	if err != nil {
 		return nil, err
 	}
+	clt.rabbit = rabbit
+	return clt, nil
+}
 
-	topic := rabbitpubsub.OpenTopic(rabbitConn, broker.TopicName, nil)
+func newMemPublisherClient(
+	logger *zap.SugaredLogger, broker *Broker, ctx context.Context,
+) (*PubClient, error) {
 	return &PubClient{
-		topic:      topic,
-		logger:     logger,
-		ctx:        ctx,
-		rabbitConn: rabbitConn,
+		topic:  getMemTopic(broker.TopicName).topic,
+		logger: logger,
+		ctx:    ctx,
+		shared: true,
 	}, nil
 }
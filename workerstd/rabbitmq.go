@@ -0,0 +1,484 @@
+package workerstd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.uber.org/zap"
+	"gocloud.dev/pubsub"
+)
+
+// rabbitReconnectPolicy is the backoff policy used when reconnecting to RabbitMQ after the connection is lost.
+var rabbitReconnectPolicy = &RetryPolicy{
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// rabbitConnection maintains a connection to RabbitMQ. The connection is watched with NotifyClose, and when it is lost,
+// it is reestablished in the background with exponential backoff. The open function is called with the new connection
+// each time the connection is (re)established, so that the clients can reopen the gocloud topic or subscription.
+type rabbitConnection struct {
+	logger    *zap.SugaredLogger
+	url       string
+	tlsConfig *tls.Config
+	open      func(conn *amqp.Connection)
+
+	// declareTopology declares the topology of the topic on each (re)connect. Only set when DeclareTopology is enabled.
+	declareTopology func(conn *amqp.Connection) error
+
+	mu        sync.RWMutex
+	conn      *amqp.Connection
+	connected bool
+
+	// delayMu guards the confirm channel that publishes the scheduled messages to the delay and retry queues, and the
+	// set of those queues that were declared on the current connection. Both are reset when the connection is
+	// (re)established.
+	delayMu       sync.Mutex
+	delayCh       *amqp.Channel
+	delayDeclared map[string]bool
+
+	closeCh chan struct{}
+	doneCh  chan struct{}
+}
+
+// dialRabbitMQ connects to the RabbitMQ server configured on the broker and starts watching the connection for
+// reconnection. The open function is called with the initial connection before this returns.
+func dialRabbitMQ(
+	logger *zap.SugaredLogger, broker *Broker, open func(conn *amqp.Connection),
+) (*rabbitConnection, error) {
+	amqpURL, err := rabbitMQURL(broker)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := rabbitMQTLSConfig(broker)
+	if err != nil {
+		return nil, err
+	}
+	c := &rabbitConnection{
+		logger:    logger,
+		url:       amqpURL,
+		tlsConfig: tlsConfig,
+		open:      open,
+		closeCh:   make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+	if broker.RabbitMQ != nil && broker.RabbitMQ.DeclareTopology {
+		c.declareTopology = func(conn *amqp.Connection) error {
+			return declareRabbitMQTopology(conn, broker)
+		}
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	notifyCh := c.setConn(conn)
+
+	go c.watch(notifyCh)
+	return c, nil
+}
+
+// rabbitMQURL returns the AMQP URL for connecting to the RabbitMQ server configured on the broker. This returns an
+// error if the scheme is not amqp or amqps, or if TLS is configured with the amqp scheme, as the TLS config would
+// otherwise be silently ignored.
+func rabbitMQURL(broker *Broker) (string, error) {
+	cfg := broker.RabbitMQ
+	if cfg == nil {
+		return fmt.Sprintf("amqp://%s/", broker.ConnectionString), nil
+	}
+
+	scheme := cfg.Scheme
+	switch {
+	case scheme == "" && cfg.TLS != nil:
+		scheme = "amqps"
+	case scheme == "":
+		scheme = "amqp"
+	case scheme != "amqp" && scheme != "amqps":
+		return "", fmt.Errorf("Unsupported RabbitMQ scheme %s: must be amqp or amqps", scheme)
+	case scheme == "amqp" && cfg.TLS != nil:
+		return "", fmt.Errorf("RabbitMQ TLS is configured with the amqp scheme: use amqps instead")
+	}
+	return fmt.Sprintf("%s://%s/%s", scheme, broker.ConnectionString, url.PathEscape(cfg.VHost)), nil
+}
+
+// rabbitMQTLSConfig returns the TLS config for connecting to the RabbitMQ server configured on the broker, or nil if
+// the default TLS config should be used.
+func rabbitMQTLSConfig(broker *Broker) (*tls.Config, error) {
+	if broker.RabbitMQ == nil || broker.RabbitMQ.TLS == nil {
+		return nil, nil
+	}
+	cfg := broker.RabbitMQ.TLS
+
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CACertFile != "" {
+		caCerts, err := os.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCerts) {
+			return nil, fmt.Errorf("No valid CA certificates found in %s", cfg.CACertFile)
+		}
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// rabbitMQQueueName returns the name of the queue that the subscriber clients of the broker consume.
+func rabbitMQQueueName(broker *Broker) string {
+	if broker.RabbitMQ != nil && broker.RabbitMQ.QueueName != "" {
+		return broker.RabbitMQ.QueueName
+	}
+	return broker.TopicName
+}
+
+// declareRabbitMQTopology declares the exchange, queue and binding of the topic of the broker, along with the
+// dead-letter exchange and its queue if configured. All the entities are declared as durable.
+func declareRabbitMQTopology(conn *amqp.Connection, broker *Broker) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	cfg := broker.RabbitMQ
+	queueArgs := amqp.Table{}
+	for k, v := range cfg.QueueArgs {
+		queueArgs[k] = v
+	}
+	if cfg.DeadLetterExchange != "" {
+		if err := declareRabbitMQFanout(ch, cfg.DeadLetterExchange, cfg.DeadLetterExchange, nil); err != nil {
+			return fmt.Errorf("Error declaring dead-letter exchange %s: %w", cfg.DeadLetterExchange, err)
+		}
+		queueArgs["x-dead-letter-exchange"] = cfg.DeadLetterExchange
+	}
+
+	queue := rabbitMQQueueName(broker)
+	if err := declareRabbitMQFanout(ch, broker.TopicName, queue, queueArgs); err != nil {
+		return fmt.Errorf("Error declaring exchange %s and queue %s: %w", broker.TopicName, queue, err)
+	}
+	return nil
+}
+
+// declareRabbitMQFanout declares a durable fanout exchange, and a durable queue with the given arguments that is bound
+// to it.
+func declareRabbitMQFanout(ch *amqp.Channel, exchange, queue string, queueArgs amqp.Table) error {
+	if err := ch.ExchangeDeclare(exchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		return err
+	}
+	if _, err := ch.QueueDeclare(queue, true, false, false, false, queueArgs); err != nil {
+		return err
+	}
+	return ch.QueueBind(queue, "", exchange, false, nil)
+}
+
+// dial opens a new connection to RabbitMQ, and declares the topology of the topic if enabled.
+func (c *rabbitConnection) dial() (*amqp.Connection, error) {
+	var conn *amqp.Connection
+	var err error
+	switch {
+	case c.tlsConfig != nil && len(c.tlsConfig.Certificates) > 0:
+		// NOTE: authenticate with the client certificate (the EXTERNAL mechanism) instead of the PLAIN credentials of the
+		// URL, as the certificate is the identity of the client.
+		conn, err = amqp.DialTLS_ExternalAuth(c.url, c.tlsConfig)
+	case c.tlsConfig != nil:
+		conn, err = amqp.DialTLS(c.url, c.tlsConfig)
+	default:
+		conn, err = amqp.Dial(c.url)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if c.declareTopology != nil {
+		if err := c.declareTopology(conn); err != nil {
+			if closeErr := conn.Close(); closeErr != nil {
+				c.logger.Debugf("Error closing RabbitMQ connection: %s", closeErr)
+			}
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// isConnected returns whether the connection to RabbitMQ is currently up.
+func (c *rabbitConnection) isConnected() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.connected
+}
+
+// reopen calls the open function again on the current connection, if it is up. This is used to recover from channel
+// level errors, where the connection is still up but the gocloud topic or subscription is no longer usable.
+func (c *rabbitConnection) reopen() {
+	c.mu.RLock()
+	conn, connected := c.conn, c.connected
+	c.mu.RUnlock()
+
+	if connected && !conn.IsClosed() {
+		c.open(conn)
+	}
+}
+
+// channel opens a new channel on the current connection. This returns an error wrapping ErrBrokerUnavailable while
+// reconnecting to RabbitMQ.
+func (c *rabbitConnection) channel() (*amqp.Channel, error) {
+	c.mu.RLock()
+	conn, connected := c.conn, c.connected
+	c.mu.RUnlock()
+
+	if !connected {
+		return nil, fmt.Errorf("%w: reconnecting to RabbitMQ", ErrBrokerUnavailable)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBrokerUnavailable, err)
+	}
+	return ch, nil
+}
+
+// Close stops reconnecting and closes the current connection.
+func (c *rabbitConnection) Close() error {
+	close(c.closeCh)
+	<-c.doneCh
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = false
+	if c.conn.IsClosed() {
+		return nil
+	}
+	if err := c.conn.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// setConn makes the given connection the current connection, and returns the channel that is notified when the
+// connection is closed. The channel is registered before the connection is used, so that a connection that is lost in
+// the meantime is still reported.
+func (c *rabbitConnection) setConn(conn *amqp.Connection) <-chan *amqp.Error {
+	notifyCh := conn.NotifyClose(make(chan *amqp.Error, 1))
+	c.open(conn)
+
+	c.delayMu.Lock()
+	c.delayCh = nil
+	c.delayDeclared = map[string]bool{}
+	c.delayMu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
+	c.connected = true
+	return notifyCh
+}
+
+// watch waits for the connection to be closed by the server or the network, and reconnects when that happens.
+func (c *rabbitConnection) watch(notifyCh <-chan *amqp.Error) {
+	defer close(c.doneCh)
+
+	for {
+		select {
+		case <-c.closeCh:
+			return
+		case amqpErr, ok := <-notifyCh:
+			// NOTE: the notify channel is closed without an error when the connection was closed gracefully, or when it
+			// was already closed by the time the channel was registered. Only the former happens on Close, which closes
+			// closeCh first.
+			select {
+			case <-c.closeCh:
+				return
+			default:
+			}
+			if ok {
+				c.logger.Errorf("Lost connection to RabbitMQ: %s", amqpErr)
+			} else {
+				c.logger.Errorf("Lost connection to RabbitMQ")
+			}
+		}
+
+		c.mu.Lock()
+		c.connected = false
+		c.mu.Unlock()
+
+		newNotifyCh, reconnected := c.reconnect()
+		if !reconnected {
+			return
+		}
+		notifyCh = newNotifyCh
+	}
+}
+
+// reconnect dials RabbitMQ with exponential backoff until it succeeds, or until the connection is closed. Returns the
+// close notification channel of the new connection, or false if the connection was closed before reconnecting.
+func (c *rabbitConnection) reconnect() (<-chan *amqp.Error, bool) {
+	for attempt := 1; ; attempt++ {
+		backoff := rabbitReconnectPolicy.backoff(attempt)
+		c.logger.Infof("Reconnecting to RabbitMQ (attempt %d) in %s", attempt, backoff)
+		select {
+		case <-c.closeCh:
+			return nil, false
+		case <-time.After(backoff):
+		}
+
+		conn, err := c.dial()
+		if err != nil {
+			c.logger.Warnf("Error reconnecting to RabbitMQ: %s", err)
+			continue
+		}
+		notifyCh := c.setConn(conn)
+		c.logger.Infof("Reconnected to RabbitMQ")
+		return notifyCh, true
+	}
+}
+
+// rabbitMQDelayQueueName returns the name of the queue that holds the scheduled messages of the given exchange until
+// they are due.
+func rabbitMQDelayQueueName(exchange string) string {
+	return exchange + ".delay"
+}
+
+// rabbitMQDeliveryCountHeader is the header in which RabbitMQ records the number of previous deliveries of a message on
+// quorum queues.
+const rabbitMQDeliveryCountHeader = "x-delivery-count"
+
+// rabbitMQRetryQueueName returns the name of the queue that holds the messages that are retried on the given queue
+// until they are due.
+func rabbitMQRetryQueueName(queue string) string {
+	return queue + ".retry"
+}
+
+// rabbitMQPublishing returns the AMQP message for the given pubsub message, with the metadata recorded in the headers
+// as is done by the gocloud topic.
+func rabbitMQPublishing(msg *pubsub.Message, messageID string) *amqp.Publishing {
+	publishing := &amqp.Publishing{
+		Headers:   amqp.Table{},
+		Body:      msg.Body,
+		MessageId: messageID,
+	}
+	for k, v := range msg.Metadata {
+		publishing.Headers[k] = v
+	}
+	return publishing
+}
+
+// publishDelayed publishes the given message to the exchange once the given time is reached. See publishToDelayQueue.
+func (c *rabbitConnection) publishDelayed(
+	ctx context.Context, exchange string, msg *amqp.Publishing, at time.Time,
+) error {
+	return c.publishToDelayQueue(ctx, rabbitMQDelayQueueName(exchange), amqp.Table{
+		"x-dead-letter-exchange": exchange,
+		// NOTE: without this, expired messages keep the routing key of the delay queue, which would not match the bindings
+		// of a direct or topic exchange. The topic publishes with an empty routing key.
+		"x-dead-letter-routing-key": "",
+	}, msg, at)
+}
+
+// publishRetry publishes the given message to the queue (and none of the other queues bound to the exchange of the
+// topic) once the given time is reached. See publishToDelayQueue.
+func (c *rabbitConnection) publishRetry(ctx context.Context, queue string, msg *amqp.Publishing, at time.Time) error {
+	return c.publishToDelayQueue(ctx, rabbitMQRetryQueueName(queue), amqp.Table{
+		// NOTE: the default exchange routes messages to the queue named by the routing key.
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": queue,
+	}, msg, at)
+}
+
+// publishToDelayQueue publishes the given message to be dead-lettered once the given time is reached. RabbitMQ has no
+// native scheduled delivery, so the message is published to a delay queue with a per-message TTL, and the delay queue
+// dead-letters expired messages according to the given queue arguments. The delay queue is declared on first use on
+// each connection.
+//
+// Note that RabbitMQ only expires messages at the head of a queue, so a message is never delivered before the messages
+// that were published ahead of it on the same delay queue, even if it is due earlier.
+func (c *rabbitConnection) publishToDelayQueue(
+	ctx context.Context, queue string, queueArgs amqp.Table, msg *amqp.Publishing, at time.Time,
+) error {
+	delay := time.Until(at)
+	if delay < 0 {
+		delay = 0
+	}
+	msg.Expiration = strconv.FormatInt(delay.Milliseconds(), 10)
+
+	confirm, err := c.publishToDelayQueueLocked(ctx, queue, queueArgs, msg)
+	if err != nil {
+		return err
+	}
+	// NOTE: wait for the confirmation outside of the lock, so that the scheduled messages are confirmed concurrently.
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return fmt.Errorf("RabbitMQ did not accept the scheduled message")
+	}
+	return nil
+}
+
+// publishToDelayQueueLocked publishes the given message to the delay queue on the shared confirm channel, declaring
+// the queue if it was not yet declared on the current connection.
+func (c *rabbitConnection) publishToDelayQueueLocked(
+	ctx context.Context, queue string, queueArgs amqp.Table, msg *amqp.Publishing,
+) (*amqp.DeferredConfirmation, error) {
+	c.delayMu.Lock()
+	defer c.delayMu.Unlock()
+
+	ch, err := c.delayChannel()
+	if err != nil {
+		return nil, err
+	}
+	if !c.delayDeclared[queue] {
+		if _, err := ch.QueueDeclare(queue, true, false, false, false, queueArgs); err != nil {
+			return nil, err
+		}
+		c.delayDeclared[queue] = true
+	}
+	return ch.PublishWithDeferredConfirmWithContext(ctx, "", queue, false, false, *msg)
+}
+
+// delayChannel returns the confirm channel that publishes the scheduled messages, opening it on the current connection
+// if it is not open. This must be called with delayMu held.
+func (c *rabbitConnection) delayChannel() (*amqp.Channel, error) {
+	if c.delayCh != nil && !c.delayCh.IsClosed() {
+		return c.delayCh, nil
+	}
+
+	ch, err := c.channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		if closeErr := ch.Close(); closeErr != nil {
+			c.logger.Debugf("Error closing RabbitMQ channel: %s", closeErr)
+		}
+		return nil, err
+	}
+	c.delayCh = ch
+	return ch, nil
+}
+
+// isRabbitMQConnErr returns whether the given error was caused by a closed RabbitMQ connection or channel.
+func isRabbitMQConnErr(err error, errorAs func(error, interface{}) bool) bool {
+	var amqpErr *amqp.Error
+	return errors.Is(err, amqp.ErrClosed) || errorAs(err, &amqpErr)
+}
@@ -0,0 +1,160 @@
+package workerstd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gocloud.dev/pubsub"
+	"golang.org/x/time/rate"
+)
+
+// DefaultRateLimitMaxDelay is how long a task can wait for the rate limits before it is requeued, when
+// App.RateLimitMaxDelay is not set.
+const DefaultRateLimitMaxDelay = 1 * time.Second
+
+// rateLimiterSweepInterval is how often the limiters of the keys that are no longer limited are removed.
+const rateLimiterSweepInterval = 1 * time.Minute
+
+// RateLimit is a token bucket rate limit on the task handler calls of the worker.
+type RateLimit struct {
+	// Limit is the number of task handler calls per second that are allowed on average. This must be greater than 0.
+	Limit rate.Limit
+
+	// Burst is the number of task handler calls that are allowed at once, above the average Limit. Defaults to 1.
+	Burst int
+
+	// Key is the metadata key by which the tasks are limited separately, such as a tenant ID that is set on the task
+	// with WithMetadata, so that the tasks of one key can't use up the limit of the others. Tasks without the metadata
+	// key share a single limit. When empty, the limit applies to all the tasks together.
+	Key string
+}
+
+// rateLimiter enforces the rate limits of a worker App.
+type rateLimiter struct {
+	limits []*keyedLimiter
+}
+
+// keyedLimiter holds the token buckets of a RateLimit, one for each value of the metadata key.
+type keyedLimiter struct {
+	limit RateLimit
+
+	mu        sync.Mutex
+	limiters  map[string]*rate.Limiter
+	lastSweep time.Time
+}
+
+// newRateLimiter returns the rate limiter for the given limits, or nil if there are no limits.
+func newRateLimiter(limits []RateLimit) (*rateLimiter, error) {
+	if len(limits) == 0 {
+		return nil, nil
+	}
+
+	l := &rateLimiter{}
+	for i, limit := range limits {
+		if limit.Limit <= 0 {
+			return nil, fmt.Errorf("Rate limit %d must have a Limit greater than 0", i)
+		}
+		if limit.Burst < 1 {
+			limit.Burst = 1
+		}
+		l.limits = append(l.limits, &keyedLimiter{
+			limit:     limit,
+			limiters:  map[string]*rate.Limiter{},
+			lastSweep: time.Now(),
+		})
+	}
+	return l, nil
+}
+
+// reserve takes a token for the given message from all the limits that apply to it, and returns how long the task
+// must wait before it can run. The returned cancel function gives the tokens back, for when the task does not run.
+func (l *rateLimiter) reserve(msg *pubsub.Message) (delay time.Duration, cancel func()) {
+	now := time.Now()
+	reservations := make([]*rate.Reservation, 0, len(l.limits))
+	cancel = func() {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+	}
+
+	for _, limit := range l.limits {
+		// NOTE: the reservation is always OK, as the Limit is greater than 0 and the Burst is at least 1.
+		r := limit.get(msg.Metadata[limit.limit.Key], now).ReserveN(now, 1)
+		reservations = append(reservations, r)
+		if d := r.DelayFrom(now); d > delay {
+			delay = d
+		}
+	}
+	return delay, cancel
+}
+
+// get returns the token bucket for the given metadata value, creating it if it does not exist yet.
+func (l *keyedLimiter) get(key string, now time.Time) *rate.Limiter {
+	if l.limit.Key == "" {
+		key = ""
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Remove the buckets that are full, as they allow the same calls as a new bucket. This keeps the buckets of the keys
+	// that are no longer seen from piling up.
+	if now.Sub(l.lastSweep) >= rateLimiterSweepInterval {
+		for k, limiter := range l.limiters {
+			if limiter.TokensAt(now) >= float64(l.limit.Burst) {
+				delete(l.limiters, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	limiter, exists := l.limiters[key]
+	if !exists {
+		limiter = rate.NewLimiter(l.limit.Limit, l.limit.Burst)
+		l.limiters[key] = limiter
+	}
+	return limiter
+}
+
+// waitRateLimits waits until the task is within the rate limits of the App, and returns whether the task can run. When
+// the task would have to wait longer than the RateLimitMaxDelay, the message is requeued for when it is expected to be
+// within the limits instead, so that the task doesn't hold up a slot in the task pool. Tasks from subscriptions that
+// can't be requeued keep waiting in their slot, as the broker would otherwise redeliver them right away (or not at
+// all). The message is also handed back to the broker if the worker shuts down while waiting.
+func (w *worker) waitRateLimits(r *receivedTask) bool {
+	if w.limiter == nil {
+		return true
+	}
+
+	app := w.app
+	msg := r.msg
+	delay, cancel := w.limiter.reserve(msg)
+	if delay == 0 {
+		return true
+	}
+	w.health.observeRateLimited(msg)
+
+	maxDelay := app.RateLimitMaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultRateLimitMaxDelay
+	}
+	if delay <= maxDelay || !r.sub.settler.canResend() {
+		app.Logger.Debugf("Task %s is over the rate limit. Delaying for %s", msg.LoggableID, delay)
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return true
+		case <-w.ctx.Done():
+			cancel()
+			nackMsg(app.Logger, msg)
+			return false
+		}
+	}
+
+	cancel()
+	app.Logger.Infof("Task %s is over the rate limit. Requeueing in %s", msg.LoggableID, delay)
+	r.sub.settler.requeue(msg, time.Now().Add(delay))
+	return false
+}
@@ -0,0 +1,89 @@
+package workerstd
+
+import (
+	"context"
+	"fmt"
+
+	"gocloud.dev/pubsub"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// TaskRegistry dispatches tasks to typed handlers based on the protobuf full name of the task message, which is
+// recorded in the message metadata by PubClient.SendTask. This allows a single worker to process multiple task types
+// without having to implement a ReceiveTaskFn.
+//
+// Handlers are registered with RegisterTask. Since the handlers don't have access to the raw pubsub message, tasks that
+// are dispatched through the registry are always automatically acked based on the result of the handler (see
+// App.AutoAck).
+type TaskRegistry struct {
+	tasks map[protoreflect.FullName]registeredTask
+}
+
+// registeredTask is a task type that is registered on the TaskRegistry.
+type registeredTask struct {
+	newTask func() proto.Message
+	handle  func(ctx context.Context, task proto.Message) error
+}
+
+// Make sure TaskRegistry struct adheres to the ContextTaskHandler interface.
+var _ ContextTaskHandler = (*TaskRegistry)(nil)
+
+// NewTaskRegistry returns an empty task registry.
+func NewTaskRegistry() *TaskRegistry {
+	return &TaskRegistry{
+		tasks: map[protoreflect.FullName]registeredTask{},
+	}
+}
+
+// RegisterTask registers the handler for the task type T, keyed by the protobuf full name of T. For example:
+//
+//	workerstd.RegisterTask(registry, func(ctx context.Context, task *pb.SendEmail) error { ... })
+//
+// This panics if a handler is already registered for the task type.
+func RegisterTask[T any, PT interface {
+	*T
+	proto.Message
+}](r *TaskRegistry, handler func(ctx context.Context, task *T) error) {
+	name := taskName(PT(new(T)))
+	if _, exists := r.tasks[name]; exists {
+		panic(fmt.Sprintf("workerstd: task %s is already registered", name))
+	}
+
+	r.tasks[name] = registeredTask{
+		newTask: func() proto.Message {
+			return PT(new(T))
+		},
+		handle: func(ctx context.Context, task proto.Message) error {
+			return handler(ctx, (*T)(task.(PT)))
+		},
+	}
+}
+
+// HandleTaskMsgCtx dispatches the decoded task to the handler registered for the task type.
+func (r *TaskRegistry) HandleTaskMsgCtx(ctx context.Context, task proto.Message, msg *pubsub.Message) error {
+	registered, exists := r.tasks[taskName(task)]
+	if !exists {
+		return Permanent(fmt.Errorf("Task %s is not registered", taskName(task)))
+	}
+	return registered.handle(ctx, task)
+}
+
+// newTaskForMsg instantiates the registered task type for the given message, based on the task name recorded in the
+// metadata.
+func (r *TaskRegistry) newTaskForMsg(msg *pubsub.Message) (proto.Message, error) {
+	name, hasName := msg.Metadata[MetadataKeyTaskName]
+	if !hasName {
+		return nil, fmt.Errorf("Message has no task name")
+	}
+	registered, exists := r.tasks[protoreflect.FullName(name)]
+	if !exists {
+		return nil, fmt.Errorf("Message has unregistered task name %s", name)
+	}
+	return registered.newTask(), nil
+}
+
+// taskName returns the protobuf full name of the given task message.
+func taskName(task proto.Message) protoreflect.FullName {
+	return task.ProtoReflect().Descriptor().FullName()
+}
@@ -0,0 +1,98 @@
+package workerstd
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"gocloud.dev/pubsub"
+)
+
+const (
+	defaultInitialBackoff = 1 * time.Second
+	defaultMultiplier     = 2.0
+)
+
+// maxAttempts returns the maximum number of attempts configured on the policy, accounting for defaults.
+func (p *RetryPolicy) maxAttempts() int {
+	if p == nil || p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// backoff returns the duration to wait before retrying the task that failed on the given attempt (starting from 1).
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	initial := p.InitialBackoff
+	if initial <= 0 {
+		initial = defaultInitialBackoff
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = defaultMultiplier
+	}
+
+	backoff := float64(initial) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		backoff += backoff * jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(backoff)
+}
+
+// msgAttempt returns the attempt number of the message. This is the attempt number recorded in the message metadata,
+// plus the number of times that the broker redelivered the message. Messages without an attempt number (e.g., those
+// that were sent by an older version of the PubClient) are assumed to be on the first attempt.
+func msgAttempt(msg *pubsub.Message) int {
+	attempt, err := strconv.Atoi(msg.Metadata[MetadataKeyAttempt])
+	if err != nil || attempt < 1 {
+		attempt = 1
+	}
+	return attempt + msgDeliveryCount(msg) - 1
+}
+
+// msgDeliveryCount returns the number of times that the broker delivered the message (starting from 1), for the
+// engines that track it. This is 1 for the other engines.
+func msgDeliveryCount(msg *pubsub.Message) int {
+	var sbMsg *azservicebus.ReceivedMessage
+	if msg.As(&sbMsg) && sbMsg.DeliveryCount > 0 {
+		return int(sbMsg.DeliveryCount)
+	}
+
+	// NOTE: RabbitMQ only records the delivery count on quorum queues, where the header is the number of previous
+	// deliveries.
+	var delivery amqp.Delivery
+	if msg.As(&delivery) {
+		if count, ok := delivery.Headers[rabbitMQDeliveryCountHeader].(int64); ok && count >= 0 {
+			return int(count) + 1
+		}
+		return 1
+	}
+
+	count, err := strconv.Atoi(msg.Metadata[MetadataKeyDeliveryCount])
+	if err != nil || count < 1 {
+		return 1
+	}
+	return count
+}
+
+// copyMsgForResend returns a new message that can be sent on a topic with the same body and metadata as the given
+// received message, with the attempt number updated.
+func copyMsgForResend(msg *pubsub.Message, attempt int) *pubsub.Message {
+	metadata := make(map[string]string, len(msg.Metadata)+1)
+	for k, v := range msg.Metadata {
+		metadata[k] = v
+	}
+	delete(metadata, MetadataKeyDeliveryCount)
+	metadata[MetadataKeyAttempt] = strconv.Itoa(attempt)
+	return &pubsub.Message{
+		Body:     msg.Body,
+		Metadata: metadata,
+	}
+}
@@ -0,0 +1,97 @@
+package workerstd
+
+import (
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"gocloud.dev/pubsub"
+)
+
+// SendOption customizes how a task is sent by the PubClient.
+type SendOption func(*sendOptions)
+
+type sendOptions struct {
+	metadata     map[string]string
+	messageID    string
+	deliveryTime time.Time
+}
+
+// WithMetadata adds custom metadata to the message. Note that the metadata keys that are set by workerstd (e.g.,
+// MetadataKeyType) can not be overridden.
+func WithMetadata(metadata map[string]string) SendOption {
+	return func(o *sendOptions) {
+		if o.metadata == nil {
+			o.metadata = map[string]string{}
+		}
+		for k, v := range metadata {
+			o.metadata[k] = v
+		}
+	}
+}
+
+// WithMessageID sets the message ID on the message, which the broker can use to deduplicate messages. For Azure
+// ServiceBus, duplicate detection must be enabled on the queue or topic for this to take effect. The ID is also
+// recorded in the MetadataKeyMessageID metadata in place of the generated one, so that the worker IdempotencyStore
+// treats sends with the same ID as the same task.
+func WithMessageID(id string) SendOption {
+	return func(o *sendOptions) {
+		o.messageID = id
+	}
+}
+
+// WithDeliveryTime schedules the message to be delivered to the subscribers at the given time, instead of immediately.
+//
+// Azure ServiceBus schedules the message natively. For RabbitMQ, the message is published to a "<topic>.delay" queue
+// with a per-message TTL, which dead-letters the message back to the topic exchange once it is due. RabbitMQ only
+// expires messages at the head of the queue, so a scheduled message is not delivered before the messages that were
+// scheduled ahead of it on the same topic. For the mem engine, the message is sent by an in-process timer. This is not
+// supported with the engines registered with RegisterEngine.
+func WithDeliveryTime(at time.Time) SendOption {
+	return func(o *sendOptions) {
+		o.deliveryTime = at
+	}
+}
+
+// newSendOptions returns the send options that result from applying the given options.
+func newSendOptions(opts []SendOption) *sendOptions {
+	o := &sendOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// apply sets the options on the given message that is about to be sent.
+func (o *sendOptions) apply(msg *pubsub.Message) {
+	for k, v := range o.metadata {
+		if _, reserved := msg.Metadata[k]; !reserved {
+			msg.Metadata[k] = v
+		}
+	}
+
+	if o.messageID == "" && o.deliveryTime.IsZero() {
+		return
+	}
+	msg.BeforeSend = func(asFunc func(interface{}) bool) error {
+		var sbMsg *azservicebus.Message
+		if asFunc(&sbMsg) {
+			if o.messageID != "" {
+				sbMsg.MessageID = &o.messageID
+			}
+			if !o.deliveryTime.IsZero() {
+				sbMsg.ScheduledEnqueueTime = &o.deliveryTime
+			}
+			return nil
+		}
+
+		var publishing *amqp.Publishing
+		if asFunc(&publishing) {
+			if o.messageID != "" {
+				publishing.MessageId = o.messageID
+			}
+			return nil
+		}
+		return nil
+	}
+}
@@ -2,9 +2,11 @@ package workerstd
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"go.uber.org/zap"
@@ -12,25 +14,60 @@ import (
 	"gocloud.dev/pubsub/azuresb"
 	"gocloud.dev/pubsub/rabbitpubsub"
 	"google.golang.org/protobuf/proto"
+
+	"github.com/illumitacit/gostd/primitiveptr"
 )
 
 type SubClient struct {
-	subscription *pubsub.Subscription
+	subscriptionMu sync.RWMutex
+	subscription   *pubsub.Subscription
+
+	logger   *zap.SugaredLogger
+	receiver *azservicebus.Receiver
+	rabbit   *rabbitConnection
+
+	// closeEngine releases the connections of a registered engine. Only set when using an engine that was registered
+	// with RegisterEngine.
+	closeEngine func() error
 
-	logger     *zap.SugaredLogger
-	receiver   *azservicebus.Receiver
-	rabbitConn *amqp.Connection
+	// deadLetterPub is the publisher used to publish messages to the dead-letter topic. Only set when the broker has a
+	// DeadLetterTopicName configured.
+	deadLetterPub *DeadLetterPublisher
+
+	// shared is true when the subscription is shared with other clients in the process (as is the case with the mem
+	// engine), in which case the subscription is not shut down on Close.
+	shared bool
 }
 
 // NewSubClient returns an initialized subscriber client for the configured broker from the given application config.
 func NewSubClient(logger *zap.SugaredLogger, broker *Broker, ctx context.Context) (*SubClient, error) {
+	var clt *SubClient
+	var err error
 	switch broker.Engine {
 	case "azuresb":
-		return newAzureSBReceiverClient(logger, broker, ctx)
+		clt, err = newAzureSBReceiverClient(logger, broker, ctx)
 	case "rabbitmq":
-		return newRabbitMQSubscriberClient(logger, broker, ctx)
+		clt, err = newRabbitMQSubscriberClient(logger, broker, ctx)
+	case "mem":
+		clt, err = newMemSubscriberClient(logger, broker, ctx)
+	default:
+		clt, err = newEngineSubscriberClient(logger, broker, ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if broker.DeadLetterTopicName != "" {
+		deadLetterPub, err := NewDeadLetterPublisher(logger, broker, ctx)
+		if err != nil {
+			if closeErr := clt.Close(); closeErr != nil {
+				logger.Errorf("Error closing subscription: %s", closeErr)
+			}
+			return nil, err
+		}
+		clt.deadLetterPub = deadLetterPub
 	}
-	return nil, fmt.Errorf("Unknown engine")
+	return clt, nil
 }
 
 // Close will close all the associated connections of the given publisher client.
@@ -41,8 +78,20 @@ func (clt *SubClient) Close() error {
 
 	ctx := context.Background()
 
-	if err := clt.subscription.Shutdown(ctx); err != nil {
-		clt.logger.Errorf("Error shutting down subscription: %s", err)
+	// NOTE: there is no need to shutdown the subscription if the RabbitMQ connection is lost, as the subscription is
+	// unusable.
+	if !clt.shared && (clt.rabbit == nil || clt.rabbit.isConnected()) {
+		clt.subscriptionMu.RLock()
+		subscription := clt.subscription
+		clt.subscriptionMu.RUnlock()
+		if err := subscription.Shutdown(ctx); err != nil {
+			clt.logger.Errorf("Error shutting down subscription: %s", err)
+			return err
+		}
+	}
+
+	if err := clt.deadLetterPub.Close(); err != nil {
+		clt.logger.Errorf("Error closing dead-letter publisher: %s", err)
 		return err
 	}
 
@@ -53,53 +102,216 @@ func (clt *SubClient) Close() error {
 		}
 	}
 
-	if clt.rabbitConn != nil {
-		if err := clt.rabbitConn.Close(); err != nil {
+	if clt.rabbit != nil {
+		if err := clt.rabbit.Close(); err != nil {
 			clt.logger.Errorf("Error closing RabbitMQ connection: %s", err)
 			return err
 		}
 	}
 
+	if clt.closeEngine != nil {
+		if err := clt.closeEngine(); err != nil {
+			clt.logger.Errorf("Error closing broker connection: %s", err)
+			return err
+		}
+	}
+
 	return nil
 }
 
-// ReceiveTask will pull a task from the subscription channel and attempt to decode the received message into a task.
-// Note that this will block the thread if there are no messages available in the topic.
+// ReceiveTask will pull a task from the subscription channel and attempt to decode the received message into a task,
+// using the codec that matches the content type of the message.
+// Note that this will block the thread if there are no messages available in the topic. Messages that can not be
+// decoded into the task are dead-lettered, and an error wrapping ErrMalformedMessage is returned.
 // IMPORTANT: The caller must acknowledge the message once the task is successfully processed, either using Ack or Nack.
 func (clt *SubClient) ReceiveTask(ctx context.Context, taskPtr proto.Message) (*pubsub.Message, error) {
-	msg, err := clt.subscription.Receive(ctx)
+	msg, err := clt.receiveTaskMsg(ctx)
 	if err != nil {
-		// TODO: return as fatal error
 		return nil, err
 	}
 
-	msgType, hasType := msg.Metadata["type"]
-	if !hasType {
-		msg.Nack()
-		return nil, fmt.Errorf("Message has unknown type")
+	// Messages sent by older versions of the PubClient don't record the task name, so only validate it if it is set.
+	if name, hasName := msg.Metadata[MetadataKeyTaskName]; hasName && name != string(taskName(taskPtr)) {
+		return nil, clt.rejectMalformedMsg(msg, fmt.Errorf("Message has unexpected task name %s", name))
 	}
 
-	if msgType != "Task" {
-		msg.Nack()
-		return nil, fmt.Errorf("Message has unknown type")
+	if err := decodeTask(msg, taskPtr); err != nil {
+		return nil, clt.rejectMalformedMsg(msg, err)
 	}
+	return msg, nil
+}
 
-	if err := proto.Unmarshal(msg.Body, taskPtr); err != nil {
-		msg.Nack()
-		return nil, err
+// ReceiveRegisteredTask will pull a task from the subscription channel and decode the received message into the task
+// type that is registered in the given registry under the task name recorded in the message metadata.
+// Note that this will block the thread if there are no messages available in the topic.
+// IMPORTANT: The caller must acknowledge the message once the task is successfully processed, either using Ack or Nack.
+func (clt *SubClient) ReceiveRegisteredTask(
+	ctx context.Context, registry *TaskRegistry,
+) (proto.Message, *pubsub.Message, error) {
+	msg, err := clt.receiveTaskMsg(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	task, err := registry.newTaskForMsg(msg)
+	if err != nil {
+		return nil, nil, clt.rejectMalformedMsg(msg, err)
+	}
+
+	if err := decodeTask(msg, task); err != nil {
+		return nil, nil, clt.rejectMalformedMsg(msg, err)
+	}
+	return task, msg, nil
+}
+
+// decodeTask decodes the body of the message into the given task, using the codec that matches the content type
+// recorded in the message metadata.
+func decodeTask(msg *pubsub.Message, task proto.Message) error {
+	codec, err := CodecForContentType(msg.Metadata[MetadataKeyContentType])
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(msg.Body, task)
+}
+
+// receiveTaskMsg will pull a message from the subscription channel and validate that it represents a worker task.
+// Errors are classified as follows:
+//   - context.DeadlineExceeded if there are no messages available before the context deadline.
+//   - ErrBrokerUnavailable if the connection to the broker is temporarily lost.
+//   - ErrMalformedMessage if the message is not a worker task. The message is dead-lettered.
+//   - ErrFatal for any other error from the subscription, which gocloud does not recover from.
+func (clt *SubClient) receiveTaskMsg(ctx context.Context) (*pubsub.Message, error) {
+	msg, err := clt.receive(ctx)
+	if err != nil {
+		if errors.Is(err, ErrBrokerUnavailable) || (ctx.Err() != nil && errors.Is(err, ctx.Err())) {
+			return nil, err
+		}
+		return nil, &kindError{kind: ErrFatal, err: err}
+	}
+
+	msgType, hasType := msg.Metadata[MetadataKeyType]
+	if !hasType || msgType != MetadataTypeTask {
+		return nil, clt.rejectMalformedMsg(msg, fmt.Errorf("Message has unknown type %q", msgType))
 	}
 	return msg, nil
 }
 
+// rejectMalformedTimeout bounds how long dead-lettering a malformed message can take.
+const rejectMalformedTimeout = 30 * time.Second
+
+// rejectMalformedMsg dead-letters the given message that can not be decoded into a task, so that it is not redelivered
+// over and over again. Returns the given error wrapped with ErrMalformedMessage.
+//
+// NOTE: this does not use the context of the receive, as the receive timeout may have nearly elapsed by the time the
+// message is received.
+func (clt *SubClient) rejectMalformedMsg(msg *pubsub.Message, err error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rejectMalformedTimeout)
+	defer cancel()
+
+	malformedErr := &kindError{kind: ErrMalformedMessage, err: err}
+	if dlErr := clt.DeadLetter(ctx, msg, malformedErr); dlErr != nil {
+		clt.logger.Errorf("Error dead-lettering malformed message %s: %s", msg.LoggableID, dlErr)
+		nackMsg(clt.logger, msg)
+	}
+	return malformedErr
+}
+
+// DeadLetter moves the given message to the dead-letter destination of the broker. When the broker has a
+// DeadLetterTopicName configured, the message is published to the dead-letter topic with the failure metadata (see
+// DeadLetterPublisher) and then acked. Otherwise, this uses the native mechanism of the engine:
+//   - For Azure ServiceBus, the message is moved to the dead-letter subqueue of the queue or subscription, with the task
+//     error recorded as the dead-letter reason.
+//   - For RabbitMQ, the message is rejected without requeuing, which routes it to the dead-letter exchange if the queue
+//     is configured with one. Otherwise, RabbitMQ discards the message.
+//
+// The message should not be acked or nacked after calling this.
+func (clt *SubClient) DeadLetter(ctx context.Context, msg *pubsub.Message, taskErr error) error {
+	if clt.deadLetterPub != nil {
+		if err := clt.deadLetterPub.Publish(ctx, msg, taskErr); err != nil {
+			return err
+		}
+		msg.Ack()
+		return nil
+	}
+
+	reason := "unknown"
+	if taskErr != nil {
+		reason = taskErr.Error()
+	}
+
+	var sbMsg *azservicebus.ReceivedMessage
+	if clt.receiver != nil && msg.As(&sbMsg) {
+		return clt.receiver.DeadLetterMessage(ctx, sbMsg, &azservicebus.DeadLetterOptions{
+			Reason:           primitiveptr.String("TaskFailed"),
+			ErrorDescription: primitiveptr.String(reason),
+		})
+	}
+
+	var delivery amqp.Delivery
+	if clt.rabbit != nil && msg.As(&delivery) {
+		return delivery.Reject(false)
+	}
+
+	clt.logger.Warnf("Dead-lettering is not supported for message %s. Dropping message: %s", msg.LoggableID, reason)
+	msg.Ack()
+	return nil
+}
+
+// receive pulls a raw message from the current subscription of the client. This returns an error wrapping
+// ErrBrokerUnavailable if the connection to the broker is lost.
+func (clt *SubClient) receive(ctx context.Context) (*pubsub.Message, error) {
+	if clt.rabbit != nil && !clt.rabbit.isConnected() {
+		return nil, fmt.Errorf("%w: reconnecting to RabbitMQ", ErrBrokerUnavailable)
+	}
+
+	clt.subscriptionMu.RLock()
+	subscription := clt.subscription
+	clt.subscriptionMu.RUnlock()
+
+	msg, err := subscription.Receive(ctx)
+	if err != nil && clt.rabbit != nil && ctx.Err() == nil && isRabbitMQConnErr(err, subscription.ErrorAs) {
+		// A gocloud subscription can not recover once the underlying channel is closed, so reopen it if the connection is
+		// still up. If the connection is down, the subscription is reopened once the connection is reestablished.
+		clt.subscriptionMu.RLock()
+		isCurrent := clt.subscription == subscription
+		clt.subscriptionMu.RUnlock()
+		if isCurrent {
+			clt.rabbit.reopen()
+		}
+		return nil, fmt.Errorf("%w: %s", ErrBrokerUnavailable, err)
+	}
+	return msg, err
+}
+
+// isConnected returns whether the client is connected to the broker. Only RabbitMQ connections are tracked, so this
+// always returns true for the other engines.
+func (clt *SubClient) isConnected() bool {
+	return clt.rabbit == nil || clt.rabbit.isConnected()
+}
+
+// setSubscription replaces the pubsub subscription of the client, shutting down the previous subscription in the
+// background. This is used when the subscription is reopened after reconnecting to the broker.
+func (clt *SubClient) setSubscription(subscription *pubsub.Subscription) {
+	clt.subscriptionMu.Lock()
+	oldSubscription := clt.subscription
+	clt.subscription = subscription
+	clt.subscriptionMu.Unlock()
+
+	if oldSubscription != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := oldSubscription.Shutdown(ctx); err != nil {
+				clt.logger.Debugf("Error shutting down stale subscription: %s", err)
+			}
+		}()
+	}
+}
+
 func newAzureSBReceiverClient(
 	logger *zap.SugaredLogger, broker *Broker, ctx context.Context,
 ) (*SubClient, error) {
-	cred, err := azidentity.NewDefaultAzureCredential(nil)
-	if err != nil {
-		return nil, err
-	}
-
-	clt, err := azservicebus.NewClient(broker.ConnectionString, cred, nil)
+	clt, err := newAzureSBClient(broker)
 	if err != nil {
 		return nil, err
 	}
@@ -134,15 +346,25 @@ func newAzureSBReceiverClient(
 func newRabbitMQSubscriberClient(
 	logger *zap.SugaredLogger, broker *Broker, ctx context.Context,
 ) (*SubClient, error) {
-	rabbitConn, err := amqp.Dial(fmt.Sprintf("amqp://%s/", broker.ConnectionString))
+	clt := &SubClient{
+		logger: logger,
+	}
+	rabbit, err := dialRabbitMQ(logger, broker, func(conn *amqp.Connection) {
+		clt.setSubscription(rabbitpubsub.OpenSubscription(conn, rabbitMQQueueName(broker), nil))
+	})
 	if err != nil {
 		return nil, err
 	}
+	clt.rabbit = rabbit
+	return clt, nil
+}
 
-	subs := rabbitpubsub.OpenSubscription(rabbitConn, broker.TopicName, nil)
+func newMemSubscriberClient(
+	logger *zap.SugaredLogger, broker *Broker, ctx context.Context,
+) (*SubClient, error) {
 	return &SubClient{
-		subscription: subs,
+		subscription: getMemTopic(broker.TopicName).subscription,
 		logger:       logger,
-		rabbitConn:   rabbitConn,
+		shared:       true,
 	}, nil
 }
@@ -0,0 +1,133 @@
+package workerstd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"gocloud.dev/pubsub"
+	"google.golang.org/protobuf/proto"
+)
+
+// Subscription is a subscription that the worker App consumes, along with the handler for its tasks. The App consumes
+// the subscription of its Broker, as well as any number of additional Subscriptions.
+//
+// When tasks from multiple subscriptions are waiting to be processed, the worker picks the task from the subscription
+// with the highest Priority, so that an urgent subscription is drained before a bulk subscription. Subscriptions with
+// the same Priority share the worker in proportion to their Weight.
+type Subscription struct {
+	// Name identifies the subscription in logs, in the readiness check and in the keys of the IdempotencyStore, so it must
+	// be unique among the subscriptions of the App. Defaults to the TopicName of the Broker, so the Name must be set when
+	// consuming multiple subscriptions of the same topic.
+	Name string
+
+	// Broker is the broker configuration of the subscription. This is required.
+	Broker *Broker
+
+	// Priority is the strict priority of the subscription. Tasks from a subscription are only processed when there is no
+	// task waiting in any of the subscriptions with a higher Priority. Defaults to 0, which is the priority of the
+	// subscription of the App Broker.
+	Priority int
+
+	// Weight is the relative share of the worker that the subscription gets among the subscriptions with the same
+	// Priority. Defaults to 1.
+	Weight int
+
+	// Concurrency is the maximum number of tasks from this subscription that the worker processes at the same time,
+	// including a task that was received and is waiting for the worker. Defaults to the App Concurrency.
+	Concurrency int
+
+	// TaskHandler, ContextTaskHandler, ReceiveTaskFn, Registry and AutoAck handle the tasks of the subscription. These
+	// behave the same as the fields of the same name on the App.
+	TaskHandler        TaskHandler
+	ContextTaskHandler ContextTaskHandler
+	ReceiveTaskFn      func(ctx context.Context, subClt *SubClient) (proto.Message, *pubsub.Message, error)
+	Registry           *TaskRegistry
+	AutoAck            bool
+}
+
+// subscriptions returns the subscriptions consumed by the worker, with the subscription of the App Broker first,
+// sorted by descending Priority.
+func (app *App) subscriptions() ([]Subscription, error) {
+	var subs []Subscription
+	if app.Broker != nil {
+		subs = append(subs, Subscription{
+			Broker:             app.Broker,
+			Concurrency:        app.Concurrency,
+			TaskHandler:        app.TaskHandler,
+			ContextTaskHandler: app.ContextTaskHandler,
+			ReceiveTaskFn:      app.ReceiveTaskFn,
+			Registry:           app.Registry,
+			AutoAck:            app.AutoAck,
+		})
+	}
+	subs = append(subs, app.Subscriptions...)
+	if len(subs) == 0 {
+		return nil, errors.New("Worker has no Broker or Subscriptions to consume")
+	}
+
+	names := map[string]bool{}
+	for i := range subs {
+		if subs[i].Broker == nil {
+			return nil, fmt.Errorf("Subscription %d has no Broker", i)
+		}
+		if subs[i].Name == "" {
+			subs[i].Name = subs[i].Broker.TopicName
+		}
+		if names[subs[i].Name] {
+			return nil, fmt.Errorf("Subscription name %s is used by more than one subscription", subs[i].Name)
+		}
+		names[subs[i].Name] = true
+		if subs[i].Weight < 1 {
+			subs[i].Weight = 1
+		}
+		if subs[i].Concurrency < 1 {
+			subs[i].Concurrency = app.Concurrency
+		}
+		if subs[i].Concurrency < 1 {
+			subs[i].Concurrency = 1
+		}
+	}
+	sort.SliceStable(subs, func(i, j int) bool {
+		return subs[i].Priority > subs[j].Priority
+	})
+	return subs, nil
+}
+
+// concurrency returns the maximum number of tasks that the worker processes at the same time across all the given
+// subscriptions.
+func (app *App) concurrency(subs []Subscription) int {
+	if app.Concurrency > 0 {
+		return app.Concurrency
+	}
+	total := 0
+	for _, sub := range subs {
+		total += sub.Concurrency
+	}
+	return total
+}
+
+// receiveTask receives a task from the Sub client, using the Registry if it is set and ReceiveTaskFn otherwise.
+func (sub *Subscription) receiveTask(ctx context.Context, subClt *SubClient) (proto.Message, *pubsub.Message, error) {
+	if sub.Registry != nil {
+		return subClt.ReceiveRegisteredTask(ctx, sub.Registry)
+	}
+	return sub.ReceiveTaskFn(ctx, subClt)
+}
+
+// taskHandler returns the handler for the tasks received from the subscription.
+func (sub *Subscription) taskHandler() ContextTaskHandler {
+	switch {
+	case sub.Registry != nil:
+		return sub.Registry
+	case sub.ContextTaskHandler != nil:
+		return sub.ContextTaskHandler
+	}
+	return AdaptTaskHandler(sub.TaskHandler)
+}
+
+// autoAck returns whether the worker should acknowledge the messages based on the result of the task handler.
+func (sub *Subscription) autoAck() bool {
+	return sub.AutoAck || sub.Registry != nil
+}
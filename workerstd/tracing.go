@@ -0,0 +1,88 @@
+package workerstd
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
+	"go.opentelemetry.io/otel/trace"
+	"gocloud.dev/pubsub"
+)
+
+// tracerName is the instrumentation name of the spans created by workerstd.
+const tracerName = "github.com/illumitacit/gostd/workerstd"
+
+// defaultPropagator is the propagator used to carry the trace context in the message metadata when none is configured.
+// This is the W3C trace context format, which records the traceparent and tracestate keys.
+var defaultPropagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// tracing holds the OpenTelemetry configuration of a PubClient or worker App. The zero value uses the global
+// TracerProvider, which is a no-op unless configured with otel.SetTracerProvider, and the W3C trace context propagator.
+type tracing struct {
+	tracerProvider trace.TracerProvider
+	propagator     propagation.TextMapPropagator
+}
+
+func (t tracing) tracer() trace.Tracer {
+	tp := t.tracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+func (t tracing) textMapPropagator() propagation.TextMapPropagator {
+	if t.propagator == nil {
+		return defaultPropagator
+	}
+	return t.propagator
+}
+
+// startPublishSpan starts a producer span for sending the given message on the given topic, and injects the span
+// context into the message metadata so that the worker can continue the trace.
+func (t tracing) startPublishSpan(
+	ctx context.Context, engine, topicName string, msg *pubsub.Message,
+) (context.Context, trace.Span) {
+	ctx, span := t.tracer().Start(
+		ctx, topicName+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String(engine),
+			semconv.MessagingOperationPublish,
+			semconv.MessagingDestinationName(topicName),
+			semconv.MessagingMessageID(msg.Metadata[MetadataKeyMessageID]),
+		),
+	)
+	t.textMapPropagator().Inject(ctx, propagation.MapCarrier(msg.Metadata))
+	return ctx, span
+}
+
+// startProcessSpan extracts the trace context from the metadata of the given message, and starts a consumer span for
+// processing the task as a child of it.
+func (t tracing) startProcessSpan(
+	ctx context.Context, engine, topicName string, msg *pubsub.Message,
+) (context.Context, trace.Span) {
+	ctx = t.textMapPropagator().Extract(ctx, propagation.MapCarrier(msg.Metadata))
+	return t.tracer().Start(
+		ctx, topicName+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String(engine),
+			semconv.MessagingOperationProcess,
+			semconv.MessagingSourceName(topicName),
+			semconv.MessagingMessageID(msg.Metadata[MetadataKeyMessageID]),
+			semconv.MessagingMessagePayloadSizeBytes(len(msg.Body)),
+		),
+	)
+}
+
+// endSpan records the result of the operation on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
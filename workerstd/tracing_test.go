@@ -0,0 +1,74 @@
+package workerstd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"gocloud.dev/pubsub"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/illumitacit/gostd/workerstd/internal/workertest"
+)
+
+func TestRunMemTracePropagation(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	broker := newTestMemBroker(t, "traced")
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	pubClt, err := NewPubClient(logger, broker, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pubClt.Close()
+	pubClt.SetTracerProvider(tp)
+	if err := pubClt.SendTaskCtx(context.Background(), wrapperspb.String("traced")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The handler reports the span of its context, which must be the consumer span of the task.
+	spanCtxCh := make(chan trace.SpanContext, 1)
+	app := newTestApp(broker, func(ctx context.Context, task proto.Message, msg *pubsub.Message) error {
+		spanCtxCh <- trace.SpanContextFromContext(ctx)
+		return nil
+	})
+	app.TracerProvider = tp
+	stop := workertest.Run(t, app.Run)
+	var handlerSpanCtx trace.SpanContext
+	select {
+	case handlerSpanCtx = <-spanCtxCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the task")
+	}
+	if err := stop(); err != nil {
+		t.Errorf("Run returned error: %s", err)
+	}
+
+	var publishSpan, processSpan sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		switch span.SpanKind() {
+		case trace.SpanKindProducer:
+			publishSpan = span
+		case trace.SpanKindConsumer:
+			processSpan = span
+		}
+	}
+	if publishSpan == nil || processSpan == nil {
+		t.Fatalf("Recorded spans %v, want a publish and a process span", recorder.Ended())
+	}
+	if got, want := processSpan.Parent().SpanID(), publishSpan.SpanContext().SpanID(); got != want {
+		t.Errorf("Process span has parent %s, want the publish span %s", got, want)
+	}
+	if got, want := processSpan.SpanContext().TraceID(), publishSpan.SpanContext().TraceID(); got != want {
+		t.Errorf("Process span is in trace %s, want the trace of the publish span %s", got, want)
+	}
+	if got, want := handlerSpanCtx.SpanID(), processSpan.SpanContext().SpanID(); got != want {
+		t.Errorf("Task handler context has span %s, want the process span %s", got, want)
+	}
+}
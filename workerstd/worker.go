@@ -4,12 +4,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/illumitacit/gostd/quit"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"gocloud.dev/pubsub"
 	"google.golang.org/protobuf/proto"
@@ -21,11 +28,98 @@ type App struct {
 	TaskHandler     TaskHandler
 	ShutdownTimeout time.Duration
 
+	// ContextTaskHandler is the context-aware variant of TaskHandler. When set, this is used instead of the
+	// TaskHandler. The context passed to the handler is cancelled when the worker is shutting down, and carries the
+	// TaskTimeout deadline.
+	ContextTaskHandler ContextTaskHandler
+
+	// TaskTimeout is the maximum duration for processing a single task. When set, the context passed to the task
+	// handler has a deadline of TaskTimeout from when the handler is called. When unset, there is no deadline.
+	TaskTimeout time.Duration
+
+	// Concurrency is the maximum number of tasks that the worker processes at the same time. When all the task slots
+	// are in use, the worker stops receiving messages from the broker until a task completes. With Subscriptions, this
+	// caps the tasks across all the subscriptions, and is also the default Concurrency of each subscription. Defaults
+	// to the sum of the Concurrency of the subscriptions, which is 1 without Subscriptions so that tasks are processed
+	// one at a time.
+	Concurrency int
+
+	// AutoAck determines whether the worker should acknowledge the message based on the result of the TaskHandler. When
+	// true, the message is acked when the handler returns nil, dead-lettered when the handler returns an error wrapping
+	// ErrPermanent, and retried according to the Broker RetryPolicy on any other error (such as ErrRetryable). When
+	// false, the TaskHandler is responsible for calling Ack or Nack on the message.
+	AutoAck bool
+
+	// PanicHook is an optional function that is called whenever a task handler panics, after the panic has been
+	// recovered and logged. This is useful for tracking panics in metrics so that they can be alerted on.
+	PanicHook func(recovered interface{}, msg *pubsub.Message)
+
 	// ReceiveTaskFn is called to receive a task from the Sub client. Ideally this is not necessary, but because
 	// proto.Message is a pointer type, we can't instantiate the struct without knowing what protobuf message we want to
-	// unmarshal to.
+	// unmarshal to. Not used when Registry is set.
 	ReceiveTaskFn func(ctx context.Context, subClt *SubClient) (proto.Message, *pubsub.Message, error)
 
+	// Registry is the registry of typed task handlers. When set, tasks are decoded based on the task name recorded in
+	// the message metadata and dispatched to the registered handler, and the TaskHandler and ReceiveTaskFn are not
+	// used. Tasks dispatched through the registry are always automatically acked, regardless of the AutoAck setting.
+	Registry *TaskRegistry
+
+	// RateLimits are token bucket rate limits on the task handler calls of the worker, across all the subscriptions. A
+	// task only runs once it is within all the limits. A task over the limits waits for up to RateLimitMaxDelay in its
+	// task slot, and is otherwise requeued on the broker to be delivered again once it is expected to be within the
+	// limits. Requeueing republishes the task to the subscription alone with a delivery time, in the same way as the
+	// retries of the RetryPolicy. For the subscriptions that can't be requeued (such as Azure ServiceBus topic
+	// subscriptions and the NATS and Kafka engines), the task keeps waiting in its slot instead.
+	RateLimits []RateLimit
+
+	// RateLimitMaxDelay is the maximum duration that a task waits for the RateLimits before it is requeued instead, when
+	// its subscription can be requeued. Defaults to DefaultRateLimitMaxDelay.
+	RateLimitMaxDelay time.Duration
+
+	// Subscriptions are additional subscriptions that the worker consumes along with the subscription of the Broker,
+	// each with its own task handler, concurrency limit and priority. All the subscriptions share the shutdown of the
+	// worker and its health endpoints. Broker may be nil when the worker only consumes Subscriptions.
+	Subscriptions []Subscription
+
+	// IdempotencyStore is an optional store of the tasks that completed successfully. When set, tasks whose message ID
+	// is already recorded in the store for their subscription are acked without calling the task handler, and tasks are
+	// recorded in the store when the handler returns nil.
+	IdempotencyStore IdempotencyStore
+
+	// IdempotencyWindow is how long completed tasks are remembered in the IdempotencyStore. Defaults to
+	// DefaultIdempotencyWindow.
+	IdempotencyWindow time.Duration
+
+	// HealthPort is the port of an optional HTTP listener that serves the /healthz (liveness), /readyz (readiness) and
+	// /metrics (Prometheus) endpoints of the worker. The liveness check fails when the receive loop has not made
+	// progress within LivenessTimeout, and the readiness check fails when the worker is not connected to the broker.
+	// Disabled when 0.
+	HealthPort int
+
+	// LivenessTimeout is how long the receive loop can go without making progress before /healthz reports the worker
+	// as unhealthy. Waiting for a free task slot while the tasks are running counts as progress. Defaults to
+	// DefaultLivenessTimeout.
+	LivenessTimeout time.Duration
+
+	// MetricsRegistry is the Prometheus registry that the worker metrics are registered on and that is served on
+	// /metrics. When unset, a new registry with the Go and process collectors is used.
+	MetricsRegistry *prometheus.Registry
+
+	// TracerProvider is the OpenTelemetry TracerProvider that is used to create a consumer span for each task. The span
+	// continues the trace that is propagated in the message metadata by the PubClient, and is passed to the task
+	// handler in its context. Defaults to the global TracerProvider, which is a no-op unless configured with
+	// otel.SetTracerProvider.
+	TracerProvider trace.TracerProvider
+
+	// Propagator is the OpenTelemetry propagator that is used to extract the trace context from the message metadata.
+	// Defaults to the W3C trace context propagator (traceparent and tracestate).
+	Propagator propagation.TextMapPropagator
+
+	// Lifecycle controls the shutdown of the worker. The worker stops receiving tasks when the Lifecycle is shut down,
+	// and shuts down the Lifecycle when it stops on its own, so that apps sharing the Lifecycle stop together. The
+	// shutdown hooks of the Lifecycle are run after the worker has stopped. Defaults to quit.Default().
+	Lifecycle *quit.Lifecycle
+
 	// CloseFn is called on close. contain Any additional close routine should be handled in the custom close function passed in here.
 	CloseFn func() error
 }
@@ -34,113 +128,506 @@ type App struct {
 // handler in the foreground that traps the INT and TERM signals. When the INT or TERM signal is sent to the process,
 // this will start a graceful shutdown of the worker app, waiting up to ShutdownTimeout duration for all the worker
 // threads to stop processing.
-func RunWithSignalHandler(app *App) (returnErr error) {
-	subscription, err := NewSubClient(app.Logger, app.Broker, context.Background())
+func RunWithSignalHandler(app *App) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return app.Run(ctx)
+}
+
+// Run runs a worker process described by the App struct in the background until the given context is cancelled or the
+// Lifecycle is shut down. This will then start a graceful shutdown of the worker app, waiting up to ShutdownTimeout
+// duration for all the worker threads to stop processing. Unlike RunWithSignalHandler, this does not trap any signals,
+// so that it can be run along with other components (see the supervisor package).
+func (app *App) Run(ctx context.Context) error {
+	subs, err := app.subscriptions()
 	if err != nil {
 		return err
 	}
+	limiter, err := newRateLimiter(app.RateLimits)
+	if err != nil {
+		return err
+	}
+
+	var subscribers []*subscriber
+	for _, sub := range subs {
+		s, err := newSubscriber(app, sub)
+		if err != nil {
+			closeSubscribers(app, subscribers)
+			return err
+		}
+		subscribers = append(subscribers, s)
+	}
+
+	health, err := newWorkerHealth(app, subscribers)
+	if err != nil {
+		closeSubscribers(app, subscribers)
+		return err
+	}
+	health.serve()
 
 	app.Logger.Infof("Reading tasks from broker")
 
 	// Start the worker in the background so that we can handle shutdown signals gracefully.
+	lc := app.lifecycle()
 	errCh := make(chan error, 1)
-	waiter := quit.GetWaiter()
+	waiter := lc.Waiter()
 	waiter.Add(1)
 	go func() {
 		defer waiter.Done()
-		defer func() {
-			if err := subscription.Close(); err != nil {
-				app.Logger.Errorf("Error closing subscription: %s", err)
-				if returnErr == nil {
-					returnErr = err
-				}
-			}
+		// If the loop exits on its own (e.g., on a fatal broker error), shut down the rest of the process as well.
+		defer lc.Shutdown()
 
-			if err := app.CloseFn(); err != nil {
-				app.Logger.Errorf("Error closing connections: %s", err)
-				if returnErr == nil {
-					returnErr = err
-				}
-			}
-		}()
-
-		// TODO: handle panics for graceful recovery
-
-		// The main loop pulls messages from the pubsub broker and exectues the tasks. This uses a few techniques:
-		// - To ensure we can shutdown the worker, we run the receive task with a timeout. This is necessary so that the
-		//   main goroutine doesn't endlessly wait for a task even if there has been a message sent in the quit channel.
-		// - Use select to watch for the shutdown message in a non-blocking fashion.
-		// - Add a time.After to ensure that we don't endlessly block on waiting for the quit channel.
-		for {
-			// Use a timeout context to avoid blocking the thread on receive. This allows the worker to able to handle shutdown
-			// messages from the main thread.
-			timeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			err := receiveMsgWithTimeout(app, subscription, timeout, cancel)
-			if err != nil && !errors.Is(err, context.DeadlineExceeded) {
-				errCh <- err
-				return
-			}
-			select {
-			case <-quit.GetQuitChannel():
-				app.Logger.Debugf("Received shutdown message. Exiting loop.")
-				errCh <- nil
-				return
-			case <-timeout.Done():
-				app.Logger.Debugf("Receive loop broker wait timeout reached")
-			// NOTE: We add a tiny delay here so that the other channels get read preference. Otherwise, when they have
-			// messages, there is a small chance the time.After wins the concurrency.
-			case <-time.After(1 * time.Millisecond):
-				app.Logger.Debugf("Receive loop broker successfully handled message.")
+		err := runWorkerLoop(app, subscribers, health, limiter)
+		if closeErr := health.Close(); closeErr != nil {
+			app.Logger.Errorf("Error shutting down health server: %s", closeErr)
+			err = multierr.Append(err, closeErr)
+		}
+		err = multierr.Append(err, closeSubscribers(app, subscribers))
+		if app.CloseFn != nil {
+			if closeErr := app.CloseFn(); closeErr != nil {
+				app.Logger.Errorf("Error closing connections: %s", closeErr)
+				err = multierr.Append(err, closeErr)
 			}
 		}
+		errCh <- err
 	}()
-	go func() {
-		waiter.Wait()
-		app.Logger.Debug("Shutting down worker")
-		quit.BroadcastShutdown()
-	}()
-
-	// Wait for interrupt signal to gracefully shutdown the server with a configurable timeout.
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
-	<-sigCh
 
-	// At this point, an interrupt signal was triggered (SIGINT or SIGTERM), so start to gracefully shutdown the server.
-	app.Logger.Infof("Received interrupt signal. Gracefully shutting down worker...")
+	// Wait for the context to be cancelled, or for the Lifecycle to be shut down by another app, to gracefully shutdown
+	// the worker with a configurable timeout.
+	select {
+	case <-ctx.Done():
+		app.Logger.Infof("Received shutdown signal. Gracefully shutting down worker...")
+	case <-lc.Done():
+		app.Logger.Infof("Received shutdown message. Gracefully shutting down worker...")
+	}
 	timeout, cancel := context.WithTimeout(context.Background(), app.ShutdownTimeout)
 	defer cancel()
-	quit.BroadcastShutdown()
+	lc.Shutdown()
+
+	// Wait for the main loop to exit, which only happens after all the in-flight tasks have been drained from the task
+	// pool.
 	select {
 	case <-timeout.Done():
 		app.Logger.Errorf("Timed out waiting for worker to shutdown.")
 		return fmt.Errorf("timeout")
-	case <-quit.GetQuitChannel():
+	case loopErr := <-errCh:
+		if err := lc.Wait(timeout); err != nil {
+			app.Logger.Errorf("Error running shutdown hooks: %s", err)
+			return multierr.Append(loopErr, err)
+		}
 		app.Logger.Infof("All services gracefully shutdown.")
+		return loopErr
 	}
+}
+
+// brokerUnavailableWait is how long the receive loop waits before receiving again when the broker is temporarily
+// unavailable.
+const brokerUnavailableWait = 1 * time.Second
+
+// subscriber holds the state of a subscription consumed by a running worker App.
+type subscriber struct {
+	Subscription
 
-	loopErr := <-errCh
-	return loopErr
+	client  *SubClient
+	settler *msgSettler
+
+	// slots bounds the tasks of the subscription that are in flight, including the one waiting in readyCh.
+	slots *taskPool
+
+	// readyCh holds the task that was received from the subscription and is waiting for a slot in the worker task pool.
+	readyCh chan *receivedTask
 }
 
-func receiveMsgWithTimeout(
-	app *App, subscription *SubClient,
-	timeout context.Context, cancel context.CancelFunc,
-) (returnErr error) {
-	defer cancel()
+// receivedTask is a task that was received from a subscription.
+type receivedTask struct {
+	sub  *subscriber
+	task proto.Message
+	msg  *pubsub.Message
+
+	// startProcessing starts the MaxProcessingTime of the lock renewal, and must be called when the task handler starts.
+	startProcessing func()
+
+	// stopKeepAlive stops renewing the lock on the message.
+	stopKeepAlive func()
+}
+
+// newSubscriber opens the Sub client and the retry publisher of the given subscription.
+func newSubscriber(app *App, sub Subscription) (*subscriber, error) {
+	client, err := NewSubClient(app.Logger, sub.Broker, context.Background())
+	if err != nil {
+		return nil, err
+	}
 
-	task, msg, err := app.ReceiveTaskFn(timeout, subscription)
+	settler, err := newMsgSettler(app, sub.Broker, client, context.Background())
 	if err != nil {
-		// TODO: differentiate fatal error from ignorable errors
-		if !errors.Is(err, context.DeadlineExceeded) {
-			app.Logger.Errorf("Error receiving message from broker: %s", err)
+		if closeErr := client.Close(); closeErr != nil {
+			app.Logger.Errorf("Error closing subscription %s: %s", sub.Name, closeErr)
+		}
+		return nil, err
+	}
+
+	return &subscriber{
+		Subscription: sub,
+		client:       client,
+		settler:      settler,
+		slots:        newTaskPool(sub.Concurrency),
+		readyCh:      make(chan *receivedTask, 1),
+	}, nil
+}
+
+// closeSubscribers closes the Sub clients and retry publishers of the given subscribers.
+func closeSubscribers(app *App, subscribers []*subscriber) (err error) {
+	for _, s := range subscribers {
+		if closeErr := s.settler.Close(); closeErr != nil {
+			app.Logger.Errorf("Error closing retry publisher of subscription %s: %s", s.Name, closeErr)
+			err = multierr.Append(err, closeErr)
+		}
+		if closeErr := s.client.Close(); closeErr != nil {
+			app.Logger.Errorf("Error closing subscription %s: %s", s.Name, closeErr)
+			err = multierr.Append(err, closeErr)
 		}
-		return err
 	}
-	// TODO: spawn goroutine for handling the task, but with work pooling to prevent overflowing.
-	if err := app.TaskHandler.HandleTaskMsg(task, msg); err != nil {
+	return err
+}
+
+// worker holds the state of the receive loop of a running worker App.
+type worker struct {
+	app         *App
+	subscribers []*subscriber
+	pool        *taskPool
+	health      *workerHealth
+	limiter     *rateLimiter
+
+	// ctx is the base context for the task handlers. This is cancelled when the worker is shutting down.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// readyNotifyCh is signaled when a task is added to the readyCh of any of the subscribers.
+	readyNotifyCh chan struct{}
+
+	fatalMu  sync.Mutex
+	fatalErr error
+}
+
+// runWorkerLoop pulls messages from the subscriptions and dispatches the tasks to the task pool until the worker is
+// shutdown, or there is an error receiving from the broker. In-flight tasks are drained from the task pool before
+// returning.
+func runWorkerLoop(app *App, subscribers []*subscriber, health *workerHealth, limiter *rateLimiter) error {
+	ctx, cancel := context.WithCancel(app.lifecycle().Context())
+	defer cancel()
+
+	w := &worker{
+		app:           app,
+		subscribers:   subscribers,
+		pool:          newTaskPool(app.concurrency(subscriptionsOf(subscribers))),
+		health:        health,
+		limiter:       limiter,
+		ctx:           ctx,
+		cancel:        cancel,
+		readyNotifyCh: make(chan struct{}, 1),
+	}
+	defer w.drainTaskPool()
+
+	health.setRunning(true)
+	defer health.setRunning(false)
+
+	// Each subscription is received from in its own goroutine, which hands the received tasks over to the dispatch
+	// loop. This keeps a slow or unavailable subscription from blocking the others.
+	var receivers sync.WaitGroup
+	for _, s := range subscribers {
+		s := s
+		receivers.Add(1)
+		go func() {
+			defer receivers.Done()
+			w.receiveLoop(s)
+		}()
+	}
+
+	w.dispatchLoop()
+
+	// Stop the receivers, and hand the tasks that were received but not dispatched back to the broker.
+	cancel()
+	receivers.Wait()
+	for _, s := range subscribers {
+		select {
+		case r := <-s.readyCh:
+			r.stopKeepAlive()
+			nackMsg(app.Logger, r.msg)
+			s.slots.release()
+		default:
+		}
+	}
+
+	w.fatalMu.Lock()
+	defer w.fatalMu.Unlock()
+	return w.fatalErr
+}
+
+// dispatchLoop runs the tasks received from the subscriptions on the task pool, in priority order, until the worker is
+// shutdown or one of the receivers fails.
+func (w *worker) dispatchLoop() {
+	done := w.ctx.Done()
+	for {
+		if !w.pool.acquire(done, w.health.tick) {
+			w.app.Logger.Debugf("Received shutdown message while waiting for task slot. Exiting loop.")
+			return
+		}
+
+		r := w.nextTask(done)
+		if r == nil {
+			w.pool.release()
+			w.app.Logger.Debugf("Received shutdown message while waiting for task. Exiting loop.")
+			return
+		}
+		w.pool.run(func() {
+			defer r.sub.slots.release()
+			defer r.stopKeepAlive()
+			w.processTask(r)
+		})
+	}
+}
+
+// nextTask blocks until a task is received from any of the subscriptions, and returns the task to run next. This
+// returns nil if the done channel is closed first.
+func (w *worker) nextTask(done <-chan struct{}) *receivedTask {
+	for {
+		if r := w.pickReadyTask(); r != nil {
+			return r
+		}
+		select {
+		case <-w.readyNotifyCh:
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// pickReadyTask returns a task that is waiting in the highest priority subscriptions, choosing between subscriptions of
+// the same priority at random in proportion to their weight. This returns nil if there is no task waiting.
+func (w *worker) pickReadyTask() *receivedTask {
+	// NOTE: the subscribers are sorted by descending priority, and only the dispatch loop reads from readyCh, so a
+	// subscriber with a non-empty readyCh is guaranteed to have a task to return.
+	var candidates []*subscriber
+	totalWeight := 0
+	for _, s := range w.subscribers {
+		if len(candidates) > 0 && s.Priority < candidates[0].Priority {
+			break
+		}
+		if len(s.readyCh) == 0 {
+			continue
+		}
+		candidates = append(candidates, s)
+		totalWeight += s.Weight
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	n := rand.Intn(totalWeight)
+	for _, s := range candidates {
+		n -= s.Weight
+		if n < 0 {
+			return <-s.readyCh
+		}
+	}
+	return <-candidates[len(candidates)-1].readyCh
+}
+
+// receiveLoop pulls messages from the subscription and hands them over to the dispatch loop until the worker is
+// shutdown, or there is an error receiving from the broker, in which case the worker is stopped.
+func (w *worker) receiveLoop(s *subscriber) {
+	app := w.app
+	done := w.ctx.Done()
+
+	// The receive loop uses a few techniques:
+	// - To apply backpressure, a slot of the subscription is acquired before receiving a message. The slot is released
+	//   when the task handler completes.
+	// - To ensure we can shutdown the worker, we run the receive task with a timeout. This is necessary so that the
+	//   goroutine doesn't endlessly wait for a task even if the worker is shutting down.
+	for {
+		if !s.slots.acquire(done, w.health.tick) {
+			app.Logger.Debugf("Received shutdown message while waiting for slot of subscription %s. Exiting loop.", s.Name)
+			return
+		}
+
+		// Use a timeout context to avoid blocking the thread on receive. This allows the worker to able to handle shutdown
+		// messages from the main thread.
+		timeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		task, msg, err := s.receiveTask(timeout, s.client)
+		cancel()
+		w.health.tick()
+		w.health.setBrokerAvailable(s.Name, !errors.Is(err, ErrBrokerUnavailable))
+		if err != nil {
+			s.slots.release()
+		}
+		switch {
+		case err == nil:
+		case errors.Is(err, context.DeadlineExceeded):
+			app.Logger.Debugf("Receive loop broker wait timeout reached for subscription %s", s.Name)
+			continue
+		case errors.Is(err, ErrMalformedMessage):
+			// The subscriber client already dead-lettered the message, so skip it and move on to the next one.
+			app.Logger.Warnf("Skipping malformed message from subscription %s: %s", s.Name, err)
+			continue
+		case errors.Is(err, ErrBrokerUnavailable):
+			// Wait for the client to reconnect to the broker before trying again.
+			app.Logger.Warnf("Broker is unavailable. Waiting before receiving again from subscription %s: %s", s.Name, err)
+			select {
+			case <-done:
+				app.Logger.Debugf("Received shutdown message while broker is unavailable. Exiting loop.")
+				return
+			case <-time.After(brokerUnavailableWait):
+			}
+			continue
+		default:
+			// This is either ErrFatal, or an unclassified error returned by a custom ReceiveTaskFn, both of which are treated
+			// as fatal.
+			app.Logger.Errorf("Error receiving message from subscription %s: %s", s.Name, err)
+			w.fatal(err)
+			return
+		}
+
+		// Keep the message locked until it is settled, which may include waiting for a slot in the task pool and the
+		// retry backoff.
+		r := &receivedTask{
+			sub:  s,
+			task: task,
+			msg:  msg,
+		}
+		r.startProcessing, r.stopKeepAlive = s.client.keepAlive(
+			msg, s.Broker.LockRenewalInterval, s.Broker.MaxProcessingTime,
+		)
+		select {
+		case s.readyCh <- r:
+		case <-done:
+			r.stopKeepAlive()
+			nackMsg(app.Logger, msg)
+			s.slots.release()
+			return
+		}
+		select {
+		case w.readyNotifyCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// fatal records the error that stopped a receive loop, and stops the worker.
+func (w *worker) fatal(err error) {
+	w.fatalMu.Lock()
+	defer w.fatalMu.Unlock()
+	w.fatalErr = multierr.Append(w.fatalErr, err)
+	w.cancel()
+}
+
+// drainTaskPool waits for all the in-flight tasks in the pool to complete. Note that this does not enforce a timeout,
+// as the ShutdownTimeout is enforced by App.Run.
+func (w *worker) drainTaskPool() {
+	w.app.Logger.Debugf("Waiting for in-flight tasks to complete.")
+	if err := w.pool.wait(context.Background()); err != nil {
+		w.app.Logger.Errorf("Error waiting for in-flight tasks to complete: %s", err)
+	}
+}
+
+// processTask runs the task handler for a task that was received from a subscription, and settles the message
+// according to the result.
+func (w *worker) processTask(r *receivedTask) {
+	app := w.app
+	sub, msg := r.sub, r.msg
+
+	if w.isDuplicate(&sub.Subscription, msg) {
+		msg.Ack()
+		app.Logger.Infof("Skipping task %s that already completed", msg.LoggableID)
+		return
+	}
+	if !w.waitRateLimits(r) {
+		return
+	}
+
+	// NOTE: the MaxProcessingTime of the handler starts here, so start the one of the lock renewal at the same time.
+	r.startProcessing()
+	ctx, span := app.tracing().startProcessSpan(w.ctx, sub.Broker.Engine, sub.Broker.TopicName, msg)
+	observe := w.health.observeTask(msg)
+	err := w.callTaskHandler(ctx, sub, r.task, msg)
+	observe(err)
+	endSpan(span, err)
+	if err == nil {
+		w.markDone(&sub.Subscription, msg)
+	}
+	var panicErr *PanicError
+	switch {
+	case sub.autoAck() && w.ctx.Err() != nil && errors.Is(err, context.Canceled):
+		// The handler was interrupted by the shutdown of the worker, which is not a failure of the task, so it should not
+		// use up an attempt of the RetryPolicy.
+		app.Logger.Infof("Task %s was interrupted by shutdown. Handing it back to the broker.", msg.LoggableID)
+		settleAutoAckedMsg(app, msg, func() { sub.settler.handBack(msg) })
+	case sub.autoAck():
+		settleAutoAckedMsg(app, msg, func() { sub.settler.settle(msg, err) })
+	case errors.As(err, &panicErr):
+		// The handler didn't get a chance to settle the message, so nack it here to make sure it isn't stuck until the
+		// broker redelivers it.
+		nackMsgAfterPanic(app, msg)
+	}
+	if err != nil {
 		// NOTE: we don't halt on task errors so that the worker continues to process other messages.
-		app.Logger.Errorf("Error processing task TODO from broker: %s", err)
+		app.Logger.Errorf("Error processing task %s from broker: %s", msg.LoggableID, err)
+		return
+	}
+	app.Logger.Infof("Successfully processed task %s", msg.LoggableID)
+}
+
+// callTaskHandler calls the task handler for the given task, recovering from any panics so that a single bad message
+// can not bring down the whole worker process. A recovered panic is logged with its stack trace and returned as a
+// PanicError.
+func (w *worker) callTaskHandler(
+	ctx context.Context, sub *subscriber, task proto.Message, msg *pubsub.Message,
+) (returnErr error) {
+	app := w.app
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr := &PanicError{Value: r, Stack: debug.Stack()}
+			app.Logger.Errorf("Recovered from panic while processing task %s: %v\n%s", msg.LoggableID, r, panicErr.Stack)
+			if app.PanicHook != nil {
+				app.PanicHook(r, msg)
+			}
+			returnErr = panicErr
+		}
+	}()
+
+	if app.TaskTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, app.TaskTimeout)
+		defer cancel()
+	}
+	if sub.Broker.MaxProcessingTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sub.Broker.MaxProcessingTime)
+		defer cancel()
+	}
+	return sub.taskHandler().HandleTaskMsgCtx(ctx, task, msg)
+}
+
+// subscriptionsOf returns the subscriptions of the given subscribers.
+func subscriptionsOf(subscribers []*subscriber) []Subscription {
+	subs := make([]Subscription, 0, len(subscribers))
+	for _, s := range subscribers {
+		subs = append(subs, s.Subscription)
+	}
+	return subs
+}
+
+// lifecycle returns the Lifecycle that controls the shutdown of the worker.
+func (app *App) lifecycle() *quit.Lifecycle {
+	if app.Lifecycle != nil {
+		return app.Lifecycle
+	}
+	return quit.Default()
+}
+
+// tracing returns the OpenTelemetry configuration of the worker.
+func (app *App) tracing() tracing {
+	return tracing{
+		tracerProvider: app.TracerProvider,
+		propagator:     app.Propagator,
 	}
-	app.Logger.Infof("Successfully processed task TODO")
-	return nil
 }
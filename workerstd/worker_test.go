@@ -0,0 +1,239 @@
+package workerstd
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"gocloud.dev/pubsub"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/illumitacit/gostd/quit"
+	"github.com/illumitacit/gostd/workerstd/internal/workertest"
+)
+
+// newTestMemBroker returns a mem engine broker for the given topic, which is reset when the test completes.
+func newTestMemBroker(t *testing.T, topic string) *Broker {
+	t.Helper()
+	ResetMemTopics()
+	t.Cleanup(ResetMemTopics)
+	return &Broker{Engine: "mem", TopicName: topic}
+}
+
+// receiveStringTask is a ReceiveTaskFn for the StringValue tasks used in the tests.
+func receiveStringTask(ctx context.Context, subClt *SubClient) (proto.Message, *pubsub.Message, error) {
+	task := &wrapperspb.StringValue{}
+	msg, err := subClt.ReceiveTask(ctx, task)
+	return task, msg, err
+}
+
+// sendStringTasks publishes a StringValue task on the broker for each of the given values.
+func sendStringTasks(t *testing.T, broker *Broker, values []string, opts ...SendOption) {
+	t.Helper()
+	pubClt, err := NewPubClient(zap.NewNop().Sugar(), broker, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pubClt.Close()
+	for _, value := range values {
+		if err := pubClt.SendTaskCtx(context.Background(), wrapperspb.String(value), opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestApp returns a worker App for the StringValue tasks of the broker, which are handled by the given handler and
+// automatically acked.
+func newTestApp(broker *Broker, handler taskHandlerFunc) *App {
+	return &App{
+		Broker:             broker,
+		Logger:             zap.NewNop().Sugar(),
+		ShutdownTimeout:    10 * time.Second,
+		ContextTaskHandler: handler,
+		ReceiveTaskFn:      receiveStringTask,
+		AutoAck:            true,
+		Lifecycle:          quit.New(),
+	}
+}
+
+// taskHandlerFunc adapts a function to the ContextTaskHandler interface.
+type taskHandlerFunc func(ctx context.Context, task proto.Message, msg *pubsub.Message) error
+
+func (f taskHandlerFunc) HandleTaskMsgCtx(ctx context.Context, task proto.Message, msg *pubsub.Message) error {
+	return f(ctx, task, msg)
+}
+
+func TestRunMemEndToEnd(t *testing.T) {
+	broker := newTestMemBroker(t, "tasks")
+	broker.RetryPolicy = &RetryPolicy{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond}
+	sendStringTasks(t, broker, []string{"a", "b", "c"})
+
+	// The task "b" fails on its first attempt, to exercise the retries.
+	receivedCh := make(chan string, 10)
+	app := newTestApp(broker, func(ctx context.Context, task proto.Message, msg *pubsub.Message) error {
+		value := task.(*wrapperspb.StringValue).GetValue()
+		if value == "b" && msgAttempt(msg) == 1 {
+			return errors.New("transient error")
+		}
+		receivedCh <- value
+		return nil
+	})
+	app.Concurrency = 2
+	stop := workertest.Run(t, app.Run)
+
+	received := workertest.CollectSorted(t, receivedCh, 3, 5*time.Second)
+	if got, want := received, []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Received tasks %v, want %v", got, want)
+	}
+	if err := stop(); err != nil {
+		t.Errorf("Run returned error: %s", err)
+	}
+}
+
+func TestResetMemTopics(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	broker := newTestMemBroker(t, "reset")
+
+	pubClt, err := NewPubClient(logger, broker, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pubClt.SendTaskCtx(context.Background(), wrapperspb.String("stale")); err != nil {
+		t.Fatal(err)
+	}
+	ResetMemTopics()
+
+	subClt, err := NewSubClient(logger, broker, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subClt.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, msg, err := receiveStringTask(ctx, subClt); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Received message %v (err %v) after reset, want no message", msg, err)
+	}
+}
+
+func TestSubscriptionsRejectDuplicateNames(t *testing.T) {
+	broker := &Broker{Engine: "mem", TopicName: "tasks"}
+	app := &App{
+		Broker:        broker,
+		Subscriptions: []Subscription{{Broker: broker}},
+	}
+	if _, err := app.subscriptions(); err == nil {
+		t.Error("Expected an error for two subscriptions with the default name of the same topic")
+	}
+
+	app.Subscriptions[0].Name = "tasks-audit"
+	if _, err := app.subscriptions(); err != nil {
+		t.Errorf("Unexpected error for subscriptions with unique names: %s", err)
+	}
+}
+
+func TestRunMemRateLimitRequeue(t *testing.T) {
+	broker := newTestMemBroker(t, "limited")
+	sendStringTasks(t, broker, []string{"a", "b", "c"}, WithMetadata(map[string]string{"tenant": "acme"}))
+
+	// Only one task runs every 200ms, and tasks never wait in their slot, so that the tasks over the limit are requeued.
+	receivedCh := make(chan string, 10)
+	app := newTestApp(broker, func(ctx context.Context, task proto.Message, msg *pubsub.Message) error {
+		value := task.(*wrapperspb.StringValue).GetValue()
+		if tenant, attempt := msg.Metadata["tenant"], msgAttempt(msg); tenant != "acme" || attempt != 1 {
+			t.Errorf("Task %s ran with tenant %q on attempt %d, want tenant acme on attempt 1", value, tenant, attempt)
+		}
+		receivedCh <- value
+		return nil
+	})
+	app.Concurrency = 3
+	app.RateLimits = []RateLimit{{Limit: 5}}
+	app.RateLimitMaxDelay = time.Millisecond
+	stop := workertest.Run(t, app.Run)
+
+	received := workertest.CollectSorted(t, receivedCh, 3, 5*time.Second)
+	if got, want := received, []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Received tasks %v, want %v", got, want)
+	}
+	if err := stop(); err != nil {
+		t.Errorf("Run returned error: %s", err)
+	}
+}
+
+func TestRunRejectsZeroRateLimit(t *testing.T) {
+	app := &App{
+		Broker:     newTestMemBroker(t, "zero"),
+		Logger:     zap.NewNop().Sugar(),
+		RateLimits: []RateLimit{{Limit: 0}},
+		Lifecycle:  quit.New(),
+	}
+	if err := app.Run(context.Background()); err == nil {
+		t.Error("Expected an error for a rate limit that never allows a task to run")
+	}
+}
+
+func TestRunMemShutdownDoesNotUseAttempt(t *testing.T) {
+	broker := newTestMemBroker(t, "interrupted")
+	broker.DeadLetterTopicName = "interrupted-dlq"
+	broker.RetryPolicy = &RetryPolicy{MaxAttempts: 1}
+	sendStringTasks(t, broker, []string{"long"})
+
+	// The task runs until the worker shuts down, on its last attempt.
+	startedCh := make(chan struct{})
+	app := newTestApp(broker, func(ctx context.Context, task proto.Message, msg *pubsub.Message) error {
+		close(startedCh)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	stop := workertest.Run(t, app.Run)
+	select {
+	case <-startedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the task to start")
+	}
+	if err := stop(); err != nil {
+		t.Errorf("Run returned error: %s", err)
+	}
+
+	// The task is handed back to the topic instead of being dead-lettered.
+	subClt, err := NewSubClient(zap.NewNop().Sugar(), broker, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subClt.Close()
+	receiveCtx, receiveCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer receiveCancel()
+	task, msg, err := receiveStringTask(receiveCtx, subClt)
+	if err != nil {
+		t.Fatalf("Task was not handed back to the topic: %s", err)
+	}
+	msg.Ack()
+	if got := task.(*wrapperspb.StringValue).GetValue(); got != "long" {
+		t.Errorf("Received task %q, want %q", got, "long")
+	}
+}
+
+func TestRunMemAutoAckHandlerSettles(t *testing.T) {
+	broker := newTestMemBroker(t, "self-acked")
+	sendStringTasks(t, broker, []string{"acked"})
+
+	// The legacy handler acks the message itself, which the worker must tolerate when it settles the message.
+	receivedCh := make(chan string, 10)
+	app := newTestApp(broker, func(ctx context.Context, task proto.Message, msg *pubsub.Message) error {
+		msg.Ack()
+		receivedCh <- task.(*wrapperspb.StringValue).GetValue()
+		return nil
+	})
+	stop := workertest.Run(t, app.Run)
+
+	workertest.CollectSorted(t, receivedCh, 1, 5*time.Second)
+	if err := stop(); err != nil {
+		t.Errorf("Run returned error: %s", err)
+	}
+	if len(receivedCh) != 0 {
+		t.Errorf("Task was processed %d more times, want once", len(receivedCh))
+	}
+}